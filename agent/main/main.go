@@ -0,0 +1,40 @@
+package main
+
+// ssh2docksal-agent is copied into the container by ssh2docksal.
+// Build it static: CGO_ENABLED=0 go build -o ssh2docksal-agent agent/main/main.go
+
+import (
+	"flag"
+	"fmt"
+	"github.com/andock/ssh2docksal/agent"
+	"io"
+	"os"
+	"time"
+)
+
+// idleReader exits the agent if no request was read for the idle duration.
+type idleReader struct {
+	reader io.Reader
+	timer  *time.Timer
+	idle   time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.timer.Reset(r.idle)
+	return n, err
+}
+
+func main() {
+	idle := flag.Duration("idle", 10*time.Minute, "Exit after being idle for this duration")
+	flag.Parse()
+
+	timer := time.AfterFunc(*idle, func() {
+		os.Exit(0)
+	})
+	err := agent.Serve(&idleReader{reader: os.Stdin, timer: timer, idle: *idle}, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
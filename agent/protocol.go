@@ -0,0 +1,145 @@
+// Package agent implements a small helper which runs inside of the container.
+// ssh2docksal copies it into the container and drives it over the stdin and
+// stdout of a single exec to perform file operations without spawning a new
+// process for each of them.
+package agent
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Operations of a request.
+const (
+	OpPing uint8 = iota
+	OpStat
+	OpLstat
+	OpReadDir
+	OpRead
+	OpWrite
+	OpRename
+	OpChmod
+	OpSymlink
+	OpReadlink
+	OpTruncate
+	OpRemove
+	OpMkdir
+	OpChown
+	OpChtimes
+	OpUnlink
+	OpRmdir
+	OpMkdirSingle
+	OpLink
+	OpStatFS
+)
+
+// Error codes of a response.
+const (
+	CodeOK uint8 = iota
+	CodeNotExist
+	CodePermission
+	CodeExist
+	CodeFailure
+)
+
+// MaxReadLength is the maximum number of bytes returned by a single OpRead.
+const MaxReadLength = 1 << 20
+
+// Request is sent from ssh2docksal to the agent.
+type Request struct {
+	Op     uint8
+	Path   string
+	Target string
+	Offset int64
+	Length int64
+	// Mode is an os.FileMode.
+	Mode uint32
+	Data []byte
+	UID  uint32
+	GID  uint32
+	// Atime and Mtime are unix nanoseconds.
+	Atime int64
+	Mtime int64
+}
+
+// Response is sent from the agent for each request.
+type Response struct {
+	Code    uint8
+	Message string
+	Info    *FileInfo
+	Entries []FileInfo
+	Data    []byte
+	EOF     bool
+	Target  string
+	FS      *FSInfo
+}
+
+// FileInfo describes a file in the container.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    uint32
+	ModTime int64
+	UID     uint32
+	GID     uint32
+}
+
+// FSInfo describes the file system of a path like statvfs(3).
+type FSInfo struct {
+	BlockSize    uint64
+	FragmentSize uint64
+	Blocks       uint64
+	BlocksFree   uint64
+	BlocksAvail  uint64
+	Files        uint64
+	FilesFree    uint64
+	FilesAvail   uint64
+	ID           uint64
+	Flags        uint64
+	NameMax      uint64
+}
+
+// File system flags of FSInfo.
+const (
+	FSReadOnly uint64 = 1
+	FSNoSuid   uint64 = 2
+)
+
+// FileMode returns the mode as os.FileMode.
+func (info *FileInfo) FileMode() os.FileMode {
+	return os.FileMode(info.Mode)
+}
+
+// Time returns the modification time.
+func (info *FileInfo) Time() time.Time {
+	return time.Unix(0, info.ModTime)
+}
+
+// Err converts the response code to an error.
+func (resp *Response) Err() error {
+	switch resp.Code {
+	case CodeOK:
+		return nil
+	case CodeNotExist:
+		return os.ErrNotExist
+	case CodePermission:
+		return os.ErrPermission
+	case CodeExist:
+		return os.ErrExist
+	}
+	return errors.New(resp.Message)
+}
+
+func errorResponse(err error) *Response {
+	resp := &Response{Code: CodeFailure, Message: err.Error()}
+	switch {
+	case os.IsNotExist(err):
+		resp.Code = CodeNotExist
+	case os.IsPermission(err):
+		resp.Code = CodePermission
+	case os.IsExist(err):
+		resp.Code = CodeExist
+	}
+	return resp
+}
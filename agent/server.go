@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Serve reads requests from in and writes the responses to out until in is closed.
+func Serve(in io.Reader, out io.Writer) error {
+	dec := gob.NewDecoder(in)
+	enc := gob.NewEncoder(out)
+	for {
+		var req Request
+		err := dec.Decode(&req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(handle(&req)); err != nil {
+			return err
+		}
+	}
+}
+
+func handle(req *Request) *Response {
+	switch req.Op {
+	case OpPing:
+		return &Response{}
+	case OpStat:
+		return statResponse(os.Stat(req.Path))
+	case OpLstat:
+		return statResponse(os.Lstat(req.Path))
+	case OpReadDir:
+		return readDir(req.Path)
+	case OpRead:
+		return read(req.Path, req.Offset, req.Length)
+	case OpWrite:
+		return write(req.Path, req.Offset, req.Data, os.FileMode(req.Mode))
+	case OpRename:
+		return result(os.Rename(req.Path, req.Target))
+	case OpChmod:
+		return result(os.Chmod(req.Path, os.FileMode(req.Mode)))
+	case OpSymlink:
+		return result(os.Symlink(req.Target, req.Path))
+	case OpReadlink:
+		target, err := os.Readlink(req.Path)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &Response{Target: target}
+	case OpTruncate:
+		return result(os.Truncate(req.Path, req.Length))
+	case OpRemove:
+		return result(os.RemoveAll(req.Path))
+	case OpMkdir:
+		return result(os.MkdirAll(req.Path, os.FileMode(req.Mode)))
+	case OpUnlink:
+		// Unlike OpRemove folders are refused.
+		return result(syscall.Unlink(req.Path))
+	case OpRmdir:
+		// Only empty folders are removed.
+		return result(syscall.Rmdir(req.Path))
+	case OpLink:
+		return result(os.Link(req.Target, req.Path))
+	case OpStatFS:
+		info, err := StatFS(req.Path)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &Response{FS: info}
+	case OpMkdirSingle:
+		// Fails if the folder exists or the parent is missing. The umask of the agent must not apply.
+		if err := os.Mkdir(req.Path, os.FileMode(req.Mode)); err != nil {
+			return errorResponse(err)
+		}
+		return result(os.Chmod(req.Path, os.FileMode(req.Mode)))
+	case OpChown:
+		return result(os.Chown(req.Path, int(req.UID), int(req.GID)))
+	case OpChtimes:
+		return result(os.Chtimes(req.Path, time.Unix(0, req.Atime), time.Unix(0, req.Mtime)))
+	}
+	return &Response{Code: CodeFailure, Message: "unknown operation"}
+}
+
+func result(err error) *Response {
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &Response{}
+}
+
+// StatFS returns the file system info of path.
+func StatFS(path string) (*FSInfo, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return &FSInfo{
+		BlockSize:    uint64(stat.Bsize),
+		FragmentSize: uint64(stat.Frsize),
+		Blocks:       stat.Blocks,
+		BlocksFree:   stat.Bfree,
+		BlocksAvail:  stat.Bavail,
+		Files:        stat.Files,
+		FilesFree:    stat.Ffree,
+		FilesAvail:   stat.Ffree,
+		ID:           uint64(uint32(stat.Fsid.X__val[0]))<<32 | uint64(uint32(stat.Fsid.X__val[1])),
+		Flags:        uint64(stat.Flags) & (FSReadOnly | FSNoSuid),
+		NameMax:      uint64(stat.Namelen),
+	}, nil
+}
+
+func newFileInfo(fi os.FileInfo) FileInfo {
+	info := FileInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		Mode:    uint32(fi.Mode()),
+		ModTime: fi.ModTime().UnixNano(),
+	}
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		info.UID = sys.Uid
+		info.GID = sys.Gid
+	}
+	return info
+}
+
+func statResponse(fi os.FileInfo, err error) *Response {
+	if err != nil {
+		return errorResponse(err)
+	}
+	info := newFileInfo(fi)
+	return &Response{Info: &info}
+}
+
+func readDir(path string) *Response {
+	dir, err := os.Open(path)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resp := &Response{Entries: make([]FileInfo, 0, len(names))}
+	for _, name := range names {
+		fi, err := os.Lstat(filepath.Join(path, name))
+		if err != nil {
+			// Removed in the meantime.
+			continue
+		}
+		resp.Entries = append(resp.Entries, newFileInfo(fi))
+	}
+	return resp
+}
+
+func read(path string, offset int64, length int64) *Response {
+	if length > MaxReadLength {
+		length = MaxReadLength
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return errorResponse(err)
+	}
+	return &Response{Data: data[:n], EOF: err == io.EOF}
+}
+
+func write(path string, offset int64, data []byte, mode os.FileMode) *Response {
+	if mode == 0 {
+		mode = 0644
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, mode)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if _, err := file.WriteAt(data, offset); err != nil {
+		file.Close()
+		return errorResponse(err)
+	}
+	return result(file.Close())
+}
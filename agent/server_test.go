@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testConn struct {
+	enc *gob.Encoder
+	dec *gob.Decoder
+	in  io.Closer
+}
+
+func startTestServer(t *testing.T) *testConn {
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	go func() {
+		err := Serve(requestReader, responseWriter)
+		responseWriter.CloseWithError(err)
+	}()
+	return &testConn{enc: gob.NewEncoder(requestWriter), dec: gob.NewDecoder(responseReader), in: requestWriter}
+}
+
+func (c *testConn) call(t *testing.T, req Request) *Response {
+	if err := c.enc.Encode(&req); err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	var resp Response
+	if err := c.dec.Decode(&resp); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	return &resp
+}
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conn := startTestServer(t)
+	defer conn.in.Close()
+	file := filepath.Join(dir, "test.txt")
+
+	if resp := conn.call(t, Request{Op: OpPing}); resp.Err() != nil {
+		t.Fatalf("Ping: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpStat, Path: file}); resp.Err() != os.ErrNotExist {
+		t.Errorf("Stat of missing file should be ErrNotExist, got %v", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpWrite, Path: file, Data: []byte("Hello")}); resp.Err() != nil {
+		t.Fatalf("Write: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpWrite, Path: file, Offset: 5, Data: []byte(" world")}); resp.Err() != nil {
+		t.Fatalf("Write at offset: %s", resp.Err())
+	}
+	resp := conn.call(t, Request{Op: OpRead, Path: file, Offset: 6, Length: 100})
+	if resp.Err() != nil || string(resp.Data) != "world" || !resp.EOF {
+		t.Errorf("Read: got %q eof %t err %v", resp.Data, resp.EOF, resp.Err())
+	}
+	resp = conn.call(t, Request{Op: OpRead, Path: file, Offset: 0, Length: 5})
+	if string(resp.Data) != "Hello" || resp.EOF {
+		t.Errorf("Ranged read: got %q eof %t", resp.Data, resp.EOF)
+	}
+	if resp := conn.call(t, Request{Op: OpChmod, Path: file, Mode: 0600}); resp.Err() != nil {
+		t.Errorf("Chmod: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpTruncate, Path: file, Length: 5}); resp.Err() != nil {
+		t.Errorf("Truncate: %s", resp.Err())
+	}
+	mtime := time.Date(2018, 4, 23, 12, 0, 0, 0, time.UTC)
+	if resp := conn.call(t, Request{Op: OpChtimes, Path: file, Atime: mtime.UnixNano(), Mtime: mtime.UnixNano()}); resp.Err() != nil {
+		t.Errorf("Chtimes: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpChown, Path: file, UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}); resp.Err() != nil {
+		t.Errorf("Chown: %s", resp.Err())
+	}
+	resp = conn.call(t, Request{Op: OpStat, Path: file})
+	if resp.Err() != nil || resp.Info.Size != 5 || resp.Info.FileMode().Perm() != 0600 || !resp.Info.Time().Equal(mtime) {
+		t.Errorf("Stat: got %+v err %v", resp.Info, resp.Err())
+	}
+	link := filepath.Join(dir, "link")
+	if resp := conn.call(t, Request{Op: OpSymlink, Path: link, Target: "test.txt"}); resp.Err() != nil {
+		t.Errorf("Symlink: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpReadlink, Path: link}); resp.Target != "test.txt" {
+		t.Errorf("Readlink: got %q", resp.Target)
+	}
+	resp = conn.call(t, Request{Op: OpLstat, Path: link})
+	if resp.Err() != nil || resp.Info.FileMode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat should return a symlink, got %+v", resp.Info)
+	}
+	if resp := conn.call(t, Request{Op: OpMkdir, Path: filepath.Join(dir, "a/b"), Mode: 0755}); resp.Err() != nil {
+		t.Errorf("Mkdir: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpRename, Path: file, Target: filepath.Join(dir, "a/b/moved.txt")}); resp.Err() != nil {
+		t.Errorf("Rename: %s", resp.Err())
+	}
+	resp = conn.call(t, Request{Op: OpReadDir, Path: dir})
+	if resp.Err() != nil || len(resp.Entries) != 2 {
+		t.Errorf("ReadDir: got %+v err %v", resp.Entries, resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpMkdirSingle, Path: filepath.Join(dir, "a/b"), Mode: 0750}); resp.Code != CodeExist {
+		t.Errorf("MkdirSingle of an existing folder: got %+v", resp)
+	}
+	if resp := conn.call(t, Request{Op: OpMkdirSingle, Path: filepath.Join(dir, "a/c"), Mode: 0750}); resp.Err() != nil {
+		t.Errorf("MkdirSingle: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpRmdir, Path: filepath.Join(dir, "a")}); resp.Err() == nil {
+		t.Errorf("Rmdir should refuse folders which are not empty")
+	}
+	if resp := conn.call(t, Request{Op: OpUnlink, Path: filepath.Join(dir, "a/c")}); resp.Err() == nil {
+		t.Errorf("Unlink should refuse folders")
+	}
+	if resp := conn.call(t, Request{Op: OpRmdir, Path: filepath.Join(dir, "a/c")}); resp.Err() != nil {
+		t.Errorf("Rmdir: %s", resp.Err())
+	}
+	hardlink := filepath.Join(dir, "hardlink")
+	if resp := conn.call(t, Request{Op: OpLink, Path: hardlink, Target: filepath.Join(dir, "a/b/moved.txt")}); resp.Err() != nil {
+		t.Errorf("Link: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpUnlink, Path: hardlink}); resp.Err() != nil {
+		t.Errorf("Unlink of the hardlink: %s", resp.Err())
+	}
+	resp = conn.call(t, Request{Op: OpStatFS, Path: dir})
+	if resp.Err() != nil || resp.FS == nil || resp.FS.Blocks == 0 || resp.FS.NameMax == 0 {
+		t.Errorf("StatFS: got %+v err %v", resp.FS, resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpUnlink, Path: link}); resp.Err() != nil {
+		t.Errorf("Unlink: %s", resp.Err())
+	}
+	if resp := conn.call(t, Request{Op: OpRemove, Path: filepath.Join(dir, "a")}); resp.Err() != nil {
+		t.Errorf("Remove: %s", resp.Err())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("Remove should delete the folder")
+	}
+}
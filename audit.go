@@ -0,0 +1,150 @@
+package ssh2docksal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a file operation of a sftp session.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Project    string    `json:"project"`
+	Service    string    `json:"service"`
+	// Op is write, copy, remove, rmdir, rename, mkdir, setstat, symlink or link.
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	// Result is ok or failed, Error is the error of failed operations.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AuditLog appends audit entries in JSON Lines format to a file or to syslog.
+// Files are rotated once they reach their maximum size.
+type AuditLog struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	keep    int
+	syslog  io.Writer
+}
+
+// OpenAuditLog opens the audit log dest: a file, "syslog" for the local syslog
+// or "syslog://host:port" for a remote one over udp. Files are rotated at
+// maxSize bytes (0 never) keeping keep old files.
+func OpenAuditLog(dest string, maxSize int64, keep int) (*AuditLog, error) {
+	if dest == "syslog" || strings.HasPrefix(dest, "syslog://") {
+		var writer *syslog.Writer
+		var err error
+		if address := strings.TrimPrefix(dest, "syslog://"); address != dest {
+			writer, err = syslog.Dial("udp", address, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "ssh2docksal")
+		} else {
+			writer, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "ssh2docksal")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &AuditLog{syslog: writer}, nil
+	}
+	l := &AuditLog{path: dest, maxSize: maxSize, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file for appending.
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, stat.Size()
+	return nil
+}
+
+// rotate renames the file to path.1, older files are shifted and the oldest is removed.
+func (l *AuditLog) rotate() error {
+	l.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.keep > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+// Write appends an entry.
+func (l *AuditLog) Write(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.syslog != nil {
+		_, err = l.syslog.Write(line)
+		return err
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	line = append(line, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.file = nil
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Audit writes a file operation of the current session to the audit log.
+func (config *Config) Audit(op string, path string, target string, bytes int64, err error) {
+	if config.AuditLog == nil {
+		return
+	}
+	entry := &AuditEntry{
+		Time:       time.Now().UTC(),
+		Key:        config.SessionKey,
+		RemoteAddr: config.RemoteAddr,
+		Project:    config.Project,
+		Service:    config.Service,
+		Op:         op,
+		Path:       path,
+		Target:     target,
+		Bytes:      bytes,
+		Result:     "ok",
+	}
+	if err != nil {
+		entry.Result, entry.Error = "failed", err.Error()
+	}
+	if err := config.AuditLog.Write(entry); err != nil {
+		log.Errorf("Unable to write the audit log: %s", err.Error())
+	}
+}
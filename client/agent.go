@@ -0,0 +1,257 @@
+package client
+
+// Client for the ssh2docksal agent which performs file operations inside of the container.
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/andock/ssh2docksal"
+	"github.com/andock/ssh2docksal/agent"
+	"github.com/apex/log"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// agentDir is the folder in the container the agent is copied to.
+const agentDir = "/tmp"
+
+// agentRetryInterval is the time to wait before starting a failed agent again.
+const agentRetryInterval = time.Minute
+
+// errAgentUnavailable is returned if the agent died. The caller falls back to docker exec.
+var errAgentUnavailable = errors.New("agent unavailable")
+
+// agents holds one running agent per container and user.
+var agents = struct {
+	sync.Mutex
+	clients map[string]*agentClient
+	failed  map[string]time.Time
+}{
+	clients: make(map[string]*agentClient),
+	failed:  make(map[string]time.Time),
+}
+
+type agentClient struct {
+	lock   sync.Mutex
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	conn   io.Closer
+	closed bool
+}
+
+// getAgent returns the running agent for the container or starts a new one.
+// Returns nil if the agent is not available.
+func getAgent(containerID string, config ssh2docksal.Config) *agentClient {
+	if config.AgentPath == "" {
+		return nil
+	}
+	key := containerID + "/" + config.DockerUser
+	agents.Lock()
+	defer agents.Unlock()
+	if a, ok := agents.clients[key]; ok && !a.isClosed() {
+		return a
+	}
+	if failed, ok := agents.failed[key]; ok && time.Since(failed) < agentRetryInterval {
+		return nil
+	}
+	a, err := startAgent(containerID, config)
+	if err != nil {
+		log.Debugf("SFTP: Agent not available in %s: %s", containerID, err.Error())
+		agents.failed[key] = time.Now()
+		delete(agents.clients, key)
+		return nil
+	}
+	delete(agents.failed, key)
+	agents.clients[key] = a
+	return a
+}
+
+// installAgent copies the agent binary into the container if it is not there yet.
+func installAgent(cli *client.Client, containerID string, agentPath string) (string, error) {
+	binary, err := ioutil.ReadFile(agentPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(binary)
+	name := fmt.Sprintf(".ssh2docksal-agent-%x", sum[:6])
+	target := agentDir + "/" + name
+	if archive, _, err := cli.CopyFromContainer(context.Background(), containerID, target); err == nil {
+		installed := isInstalledAgent(archive, sum)
+		archive.Close()
+		if installed {
+			return target, nil
+		}
+	}
+
+	log.Debugf("SFTP: Install agent %s in %s", target, containerID)
+	archive := new(bytes.Buffer)
+	tw := tar.NewWriter(archive)
+	err = tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0755,
+		Size:     int64(len(binary)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(binary); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	err = cli.CopyToContainer(context.Background(), containerID, agentDir, archive, types.CopyToContainerOptions{})
+	return target, err
+}
+
+// isInstalledAgent checks if the tar archive of an installed agent holds the
+// binary with sum, owned by root and writable by root only. Every container
+// user can plant a file with the predictable name in the agent folder, the
+// agent is replaced then. The sticky bit of /tmp keeps others from changing a
+// file of root afterwards.
+func isInstalledAgent(archive io.Reader, sum [sha256.Size]byte) bool {
+	tr := tar.NewReader(archive)
+	header, err := tr.Next()
+	if err != nil || header.Typeflag != tar.TypeReg || header.Uid != 0 || header.Mode&022 != 0 {
+		return false
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, tr); err != nil {
+		return false
+	}
+	return bytes.Equal(hash.Sum(nil), sum[:])
+}
+
+func startAgent(containerID string, config ssh2docksal.Config) (*agentClient, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	agentBinary, err := installAgent(cli, containerID, config.AgentPath)
+	if err != nil {
+		return nil, err
+	}
+	execConfig := types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{agentBinary},
+		User:         config.DockerUser,
+	}
+	resp, err := cli.ContainerExecCreate(context.Background(), containerID, execConfig)
+	if err != nil {
+		return nil, err
+	}
+	connection, err := cli.ContainerExecAttach(context.Background(), resp.ID, types.ExecConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, stdoutWriter := io.Pipe()
+	a := &agentClient{
+		enc:  gob.NewEncoder(connection.Conn),
+		dec:  gob.NewDecoder(stdout),
+		conn: connection.Conn,
+	}
+	go func() {
+		stderr := new(bytes.Buffer)
+		_, err := stdcopy.StdCopy(stdoutWriter, stderr, connection.Reader)
+		if stderr.Len() != 0 {
+			log.Errorf("SFTP: Agent: %s", stderr.String())
+		}
+		stdoutWriter.CloseWithError(err)
+		a.close()
+	}()
+
+	if _, err := a.call(&agent.Request{Op: agent.OpPing}); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *agentClient) isClosed() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.closed
+}
+
+func (a *agentClient) close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closeLocked()
+}
+
+func (a *agentClient) closeLocked() {
+	if !a.closed {
+		a.closed = true
+		a.conn.Close()
+	}
+}
+
+// call sends a request and waits for the response. Returns errAgentUnavailable
+// if the agent is gone and the error of the operation otherwise.
+func (a *agentClient) call(req *agent.Request) (*agent.Response, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil, errAgentUnavailable
+	}
+	var resp agent.Response
+	err := a.enc.Encode(req)
+	if err == nil {
+		err = a.dec.Decode(&resp)
+	}
+	if err != nil {
+		log.Debugf("SFTP: Agent failed: %s", err.Error())
+		a.closeLocked()
+		return nil, errAgentUnavailable
+	}
+	return &resp, resp.Err()
+}
+
+// agentReader reads a file in ranges through the agent.
+type agentReader struct {
+	agent *agentClient
+	path  string
+}
+
+func (r *agentReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		resp, err := r.agent.call(&agent.Request{Op: agent.OpRead, Path: r.path, Offset: off + int64(n), Length: int64(len(p) - n)})
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], resp.Data)
+		if resp.EOF {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// newAgentFile converts the agent file info of a file in folder.
+func newAgentFile(folder string, info *agent.FileInfo, containerID string) *dockerFile {
+	mode := info.FileMode()
+	file := newDockerFile(filepath.Join(folder, info.Name), mode.IsDir(), containerID)
+	file.modtime = info.Time()
+	file.size = info.Size
+	file.mode = mode
+	file.uid = info.UID
+	file.gid = info.GID
+	file.hasStat = true
+	return file
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestIsInstalledAgent(t *testing.T) {
+	binary := []byte("agent binary")
+	sum := sha256.Sum256(binary)
+	archive := func(content []byte, uid int, mode int64) *bytes.Buffer {
+		buffer := new(bytes.Buffer)
+		tw := tar.NewWriter(buffer)
+		tw.WriteHeader(&tar.Header{Name: ".ssh2docksal-agent", Mode: mode, Uid: uid, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+		tw.Close()
+		return buffer
+	}
+	if !isInstalledAgent(archive(binary, 0, 0755), sum) {
+		t.Errorf("Expected the installed agent to be used")
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		uid     int
+		mode    int64
+	}{
+		{name: "other content of the same size", content: []byte("agent-binary"), uid: 0, mode: 0755},
+		{name: "file of another user", content: binary, uid: 1000, mode: 0755},
+		{name: "file writable by others", content: binary, uid: 0, mode: 0777},
+	}
+	for _, test := range tests {
+		if isInstalledAgent(archive(test.content, test.uid, test.mode), sum) {
+			t.Errorf("Expected a %s to be replaced", test.name)
+		}
+	}
+}
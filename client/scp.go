@@ -0,0 +1,516 @@
+package client
+
+// scp protocol server which reads and writes through the docker archive api.
+// Nothing has to be installed in the container.
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/andock/ssh2docksal"
+	"github.com/apex/log"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScpLinkDepth limits how many symbolic links are followed in a row.
+const maxScpLinkDepth = 16
+
+type scpOptions struct {
+	sink      bool
+	source    bool
+	recursive bool
+	preserve  bool
+	targetDir bool
+	paths     []string
+}
+
+// parseScpCommand parses the arguments of a remote "scp -t" or "scp -f" call.
+func parseScpCommand(args []string) (*scpOptions, error) {
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, fmt.Errorf("Not a scp command: %s", strings.Join(args, " "))
+	}
+	opts := &scpOptions{}
+	noMoreFlags := false
+	for _, arg := range args[1:] {
+		if noMoreFlags || !strings.HasPrefix(arg, "-") || arg == "-" {
+			opts.paths = append(opts.paths, arg)
+			noMoreFlags = true
+			continue
+		}
+		if arg == "--" {
+			noMoreFlags = true
+			continue
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				opts.sink = true
+			case 'f':
+				opts.source = true
+			case 'r':
+				opts.recursive = true
+			case 'p':
+				opts.preserve = true
+			case 'd':
+				opts.targetDir = true
+			case 'v', 'q', 'E':
+			default:
+				return nil, fmt.Errorf("Unknown scp option -%c", flag)
+			}
+		}
+	}
+	if opts.sink == opts.source {
+		return nil, fmt.Errorf("Either -t or -f is required")
+	}
+	if len(opts.paths) == 0 {
+		opts.paths = []string{"."}
+	}
+	if opts.sink && len(opts.paths) != 1 {
+		return nil, fmt.Errorf("Ambiguous target")
+	}
+	return opts, nil
+}
+
+// Scp serves a scp upload or download for the given container.
+func (a *DockerClient) Scp(containerID string, s ssh.Session, c ssh2docksal.Config) {
+	opts, err := parseScpCommand(s.Command())
+	if err != nil {
+		log.Errorf("SCP: %s", err.Error())
+		fmt.Fprintf(s, "\x02scp: %s\n", err.Error())
+		s.Exit(1)
+		return
+	}
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		log.Errorf("Couldn't connect to docker")
+		s.Exit(255)
+		return
+	}
+	session := &scpSession{
+		cli:         cli,
+		containerID: containerID,
+		config:      c,
+		options:     opts,
+		channel:     s,
+		reader:      bufio.NewReader(s),
+	}
+	if opts.sink {
+		err = session.receive()
+	} else {
+		err = session.send()
+	}
+	if err != nil || session.failed {
+		if err != nil {
+			log.Errorf("SCP: %s", err.Error())
+			session.warn(err.Error())
+		}
+		s.Exit(1)
+		return
+	}
+	s.Exit(0)
+}
+
+type scpSession struct {
+	cli         *client.Client
+	containerID string
+	config      ssh2docksal.Config
+	options     *scpOptions
+	channel     io.Writer
+	reader      *bufio.Reader
+	failed      bool
+}
+
+// warn reports a non fatal error to the scp client.
+func (session *scpSession) warn(message string) {
+	session.failed = true
+	fmt.Fprintf(session.channel, "\x01scp: %s\n", message)
+}
+
+func (session *scpSession) ack() error {
+	_, err := session.channel.Write([]byte{0})
+	return err
+}
+
+// readAck reads the response of the client to the last message.
+func (session *scpSession) readAck() error {
+	code, err := session.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	message, err := session.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return errors.New(strings.TrimSpace(message))
+}
+
+// resolve makes a path absolute to the working directory of the container.
+func (session *scpSession) resolve(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	workingDir := "/"
+	info, err := session.cli.ContainerInspect(context.Background(), session.containerID)
+	if err == nil && info.Config != nil && info.Config.WorkingDir != "" {
+		workingDir = info.Config.WorkingDir
+	}
+	return path.Join(workingDir, p)
+}
+
+// isDir checks if the path is an existing directory in the container.
+func (session *scpSession) isDir(p string) bool {
+	for depth := 0; depth < maxScpLinkDepth; depth++ {
+		stat, err := session.cli.ContainerStatPath(context.Background(), session.containerID, p)
+		if err != nil {
+			return false
+		}
+		if stat.Mode&os.ModeSymlink == 0 || stat.LinkTarget == "" {
+			return stat.Mode.IsDir()
+		}
+		p = stat.LinkTarget
+	}
+	return false
+}
+
+// receive handles "scp -t". Everything the client sends is written into one tar
+// stream which is extracted by a single CopyToContainer call.
+func (session *scpSession) receive() error {
+	target := session.resolve(session.options.paths[0])
+	targetIsDir := session.isDir(target)
+	if session.options.targetDir && !targetIsDir {
+		return fmt.Errorf("%s: Not a directory", target)
+	}
+	extractDir := target
+	rename := ""
+	if !targetIsDir {
+		extractDir = path.Dir(target)
+		rename = path.Base(target)
+	}
+	uid, gid, err := execUserIDs(session.containerID, session.config.DockerUser)
+	if err != nil {
+		log.Warnf("SCP: Unable to lookup user %s: %s", session.config.DockerUser, err.Error())
+	}
+
+	// The sftp sessions drop the received files from their caches, even after a partial upload.
+	defer recordChange(session.containerID, extractDir, noSession)
+
+	pipeReader, pipeWriter := io.Pipe()
+	uploadErr := make(chan error, 1)
+	go func() {
+		err := session.cli.CopyToContainer(context.Background(), session.containerID, extractDir, pipeReader, types.CopyToContainerOptions{})
+		pipeReader.CloseWithError(err)
+		uploadErr <- err
+	}()
+
+	err = session.receiveArchive(tar.NewWriter(pipeWriter), rename, uid, gid)
+	pipeWriter.CloseWithError(err)
+	copyErr := <-uploadErr
+	if err != nil {
+		return err
+	}
+	return copyErr
+}
+
+func (session *scpSession) receiveArchive(tw *tar.Writer, rename string, uid int, gid int) error {
+	var dirs []string
+	var mtime, atime time.Time
+	topLevelEntries := 0
+
+	if err := session.ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := session.reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("Protocol error: empty message")
+		}
+		switch line[0] {
+		case 0x01:
+			log.Warnf("SCP: client: %s", line[1:])
+			continue
+		case 0x02:
+			return fmt.Errorf("%s", line[1:])
+		case 'T':
+			mtime, atime, err = parseScpTimes(line[1:])
+			if err != nil {
+				return err
+			}
+			if err := session.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("Protocol error: unexpected E")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := session.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("Protocol error: unexpected message %q", line)
+		}
+
+		mode, size, name, err := parseScpEntry(line[1:])
+		if err != nil {
+			return err
+		}
+		if len(dirs) == 0 {
+			topLevelEntries++
+			if rename != "" {
+				if topLevelEntries > 1 {
+					return fmt.Errorf("%s: Not a directory", rename)
+				}
+				name = rename
+			}
+		}
+		if mtime.IsZero() {
+			mtime = time.Now()
+			atime = mtime
+		}
+		header := &tar.Header{
+			Name:       path.Join(append(dirs, name)...),
+			Mode:       int64(os.FileMode(mode) &^ session.config.GetUmask()),
+			Uid:        uid,
+			Gid:        gid,
+			ModTime:    mtime,
+			AccessTime: atime,
+			// The access time is only written in the PAX format.
+			Format: tar.FormatPAX,
+		}
+		mtime, atime = time.Time{}, time.Time{}
+
+		if line[0] == 'D' {
+			if !session.options.recursive {
+				return fmt.Errorf("%s: Received directory without -r", name)
+			}
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			dirs = append(dirs, name)
+			if err := session.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Debugf("SCP: Receive file %s", header.Name)
+		header.Typeflag = tar.TypeReg
+		header.Size = size
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := session.ack(); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, session.reader, size); err != nil {
+			return err
+		}
+		if err := session.readAck(); err != nil {
+			return err
+		}
+		if err := session.ack(); err != nil {
+			return err
+		}
+	}
+	if len(dirs) != 0 {
+		return fmt.Errorf("Protocol error: unexpected end of input")
+	}
+	return tw.Close()
+}
+
+// send handles "scp -f".
+func (session *scpSession) send() error {
+	if err := session.readAck(); err != nil {
+		return err
+	}
+	for _, p := range session.options.paths {
+		p = session.resolve(p)
+		if err := session.sendPath(p, path.Base(p), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPath sends a file or directory tree as name. Errors which only affect
+// this path are reported as warnings, all other errors abort the transfer.
+func (session *scpSession) sendPath(p string, name string, depth int) error {
+	if depth > maxScpLinkDepth {
+		session.warn(fmt.Sprintf("%s: Too many levels of symbolic links", p))
+		return nil
+	}
+	reader, stat, err := session.cli.CopyFromContainer(context.Background(), session.containerID, p)
+	if err != nil {
+		session.warn(fmt.Sprintf("%s: No such file or directory", p))
+		return nil
+	}
+	defer reader.Close()
+
+	if stat.Mode&os.ModeSymlink != 0 && stat.LinkTarget != "" {
+		return session.sendPath(stat.LinkTarget, name, depth+1)
+	}
+	if stat.Mode.IsDir() && !session.options.recursive {
+		session.warn(fmt.Sprintf("%s: not a regular file", p))
+		return nil
+	}
+
+	var dirs []string
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Replace the archive root with the requested name.
+		parts := strings.Split(strings.Trim(header.Name, "/"), "/")
+		parts[0] = name
+		parents := parts[:len(parts)-1]
+		for len(dirs) > len(parents) || !equalPaths(dirs, parents[:len(dirs)]) {
+			if err := session.sendMessage("E\n"); err != nil {
+				return err
+			}
+			dirs = dirs[:len(dirs)-1]
+		}
+		entryName := parts[len(parts)-1]
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := session.sendTimes(header); err != nil {
+				return err
+			}
+			if err := session.sendMessage(fmt.Sprintf("D%04o 0 %s\n", header.Mode&07777, entryName)); err != nil {
+				return err
+			}
+			dirs = append(dirs, entryName)
+		case tar.TypeReg, tar.TypeRegA:
+			if err := session.sendTimes(header); err != nil {
+				return err
+			}
+			if err := session.sendMessage(fmt.Sprintf("C%04o %d %s\n", header.Mode&07777, header.Size, entryName)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(session.channel, tr, header.Size); err != nil {
+				return err
+			}
+			if err := session.sendMessage("\x00"); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(p), path.Dir(header.Name), target)
+			}
+			if err := session.sendPath(target, entryName, depth+1); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if err := session.sendPath(path.Join(path.Dir(p), header.Linkname), entryName, depth); err != nil {
+				return err
+			}
+		default:
+			session.warn(fmt.Sprintf("%s: not a regular file", path.Join(path.Dir(p), header.Name)))
+		}
+	}
+	for range dirs {
+		if err := session.sendMessage("E\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (session *scpSession) sendMessage(message string) error {
+	if _, err := io.WriteString(session.channel, message); err != nil {
+		return err
+	}
+	return session.readAck()
+}
+
+func (session *scpSession) sendTimes(header *tar.Header) error {
+	if !session.options.preserve {
+		return nil
+	}
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	return session.sendMessage(fmt.Sprintf("T%d 0 %d 0\n", header.ModTime.Unix(), atime.Unix()))
+}
+
+func equalPaths(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseScpEntry parses "<mode> <size> <name>" of a C or D message.
+func parseScpEntry(message string) (uint32, int64, string, error) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid entry %q", message)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid mode %q", parts[0])
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid size %q", parts[1])
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("Protocol error: invalid name %q", name)
+	}
+	return uint32(mode) & 07777, size, name, nil
+}
+
+// parseScpTimes parses "<mtime> 0 <atime> 0" of a T message.
+func parseScpTimes(message string) (time.Time, time.Time, error) {
+	parts := strings.Fields(message)
+	if len(parts) != 4 {
+		return time.Time{}, time.Time{}, fmt.Errorf("Protocol error: invalid times %q", message)
+	}
+	mtime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Protocol error: invalid mtime %q", parts[0])
+	}
+	atime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Protocol error: invalid atime %q", parts[2])
+	}
+	return time.Unix(mtime, 0), time.Unix(atime, 0), nil
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScpCommand(t *testing.T) {
+
+	tests := []struct {
+		command []string
+		options *scpOptions
+	}{
+		{command: []string{"scp", "-t", "--", "/var/www"}, options: &scpOptions{sink: true, paths: []string{"/var/www"}}},
+		{command: []string{"scp", "-r", "-d", "-t", "--", "/var/www"}, options: &scpOptions{sink: true, recursive: true, targetDir: true, paths: []string{"/var/www"}}},
+		{command: []string{"scp", "-pf", "a.txt", "-b.txt"}, options: &scpOptions{source: true, preserve: true, paths: []string{"a.txt", "-b.txt"}}},
+		{command: []string{"scp", "-f", "--", "-b.txt"}, options: &scpOptions{source: true, paths: []string{"-b.txt"}}},
+		{command: []string{"scp", "-f"}, options: &scpOptions{source: true, paths: []string{"."}}},
+		{command: []string{"scp", "-t", "a", "b"}, options: nil},
+		{command: []string{"scp", "-t", "-f", "a"}, options: nil},
+		{command: []string{"scp", "-x", "a"}, options: nil},
+		{command: []string{"ls", "-t"}, options: nil},
+	}
+
+	for _, test := range tests {
+		options, err := parseScpCommand(test.command)
+		if test.options == nil {
+			if err == nil {
+				t.Errorf("%v should be rejected", test.command)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", test.command, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.options) {
+			t.Errorf("%v: got %+v, want %+v", test.command, options, test.options)
+		}
+	}
+}
+
+func TestParseScpEntry(t *testing.T) {
+
+	tests := []struct {
+		message string
+		mode    uint32
+		size    int64
+		name    string
+		valid   bool
+	}{
+		{message: "0644 5 test.txt", mode: 0644, size: 5, name: "test.txt", valid: true},
+		{message: "0755 0 my dir", mode: 0755, size: 0, name: "my dir", valid: true},
+		{message: "0644 5 ..", valid: false},
+		{message: "0644 5 ../etc/passwd", valid: false},
+		{message: "0644 -1 test.txt", valid: false},
+		{message: "0999 5 test.txt", valid: false},
+		{message: "0644 5", valid: false},
+	}
+
+	for _, test := range tests {
+		mode, size, name, err := parseScpEntry(test.message)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q should be rejected", test.message)
+			}
+			continue
+		}
+		if err != nil || mode != test.mode || size != test.size || name != test.name {
+			t.Errorf("%q: got %o %d %q %v", test.message, mode, size, name, err)
+		}
+	}
+}
+
+func TestReceiveArchiveTimes(t *testing.T) {
+	session := &scpSession{
+		options: &scpOptions{sink: true, preserve: true, paths: []string{"/var/www"}},
+		channel: ioutil.Discard,
+		reader:  bufio.NewReader(strings.NewReader("T1500000000 0 1400000000 0\nC0644 5 a.txt\nhello\x00")),
+	}
+	archive := new(bytes.Buffer)
+	if err := session.receiveArchive(tar.NewWriter(archive), "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	header, err := tar.NewReader(archive).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.ModTime.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("Expected the mtime of the client, got %s", header.ModTime)
+	}
+	if !header.AccessTime.Equal(time.Unix(1400000000, 0)) {
+		t.Errorf("Expected the atime of the client, got %s", header.AccessTime)
+	}
+}
@@ -3,18 +3,15 @@ package client
 // sftp request server connects to docker container.
 
 import (
-	"bytes"
 	"github.com/andock/ssh2docksal"
 	"github.com/apex/log"
-	"github.com/mholt/archiver"
 	"github.com/pkg/sftp"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -22,50 +19,104 @@ func getRoot(containerID string, config ssh2docksal.Config) *root {
 	root := &root{
 		files:       make(map[string]*dockerFile),
 		containerID: containerID,
-		config: config,
+		session:     newSessionID(),
+		config:      config,
+		mounts:      getHostMounts(containerID, config),
 	}
 	root.dockerFile = newDockerFile("/", true, root.containerID)
+	root.dockerFile.root = root
+	root.expireChanges()
 	return root
 }
 
 // DocCliHandler returns a Hanlders object for docker cli.
 func DockerCliSftpHandler(containerID string, config ssh2docksal.Config) sftp.Handlers {
 	root := getRoot(containerID, config)
+	if policy := config.GetSftpPolicy(); policy.Restricted() {
+		p := newPolicyFS(root, policy)
+		return sftp.Handlers{FileGet: p, FilePut: p, FileCmd: p, FileList: p}
+	}
 	return sftp.Handlers{root, root, root, root}
 }
 
 func (fs *root) Fileread(r *sftp.Request) (io.ReaderAt, error) {
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
+	defer fs.lockPaths(r.Filepath)()
+	defer fs.execSlot()()
 
 	file, err := fs.fetch(r.Filepath)
 	if err != nil {
 		return nil, err
 	}
-	err = file.execFileDownload()
+	return fs.openReader(file)
+}
 
-	if err != nil {
-		return nil, err
+// openReader returns a reader of the file content.
+func (fs *root) openReader(file *dockerFile) (io.ReaderAt, error) {
+	if ref := fs.hostFile(file.name); ref != nil && !file.isdir {
+		defer ref.Close()
+		hostFile, err := ref.Open(os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return hostFile, nil
+	}
+	if a := fs.agent(); a != nil && !file.isdir {
+		return &agentReader{agent: a, path: file.name}, nil
 	}
-	return file.ReaderAt()
+	if file.isdir {
+		return nil, os.ErrInvalid
+	}
+	return file.execFileReader(), nil
 }
 func (fs *root) createDockerFile(path string, isdir bool, containerID string) *dockerFile {
-	fs.files[path] = newDockerFile(path, isdir, fs.containerID)
-	fs.files[path].root = *fs
-	return fs.files[path]
+	return fs.cache(path, newDockerFile(path, isdir, fs.containerID))
 }
+
+// Filewrite opens a file for writing. Failed opens are audited here, the
+// sftp channel audits uploads once they are closed.
 func (fs *root) Filewrite(r *sftp.Request) (io.WriterAt, error) {
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
+	w, err := fs.filewrite(r)
+	if err != nil {
+		fs.config.Audit("write", r.Filepath, "", 0, err)
+	}
+	return w, err
+}
+
+func (fs *root) filewrite(r *sftp.Request) (io.WriterAt, error) {
+	defer fs.lockPaths(r.Filepath)()
+	defer fs.execSlot()()
+	if fs.config.SftpLimited() {
+		if err := fs.checkQuota(r.Filepath); err != nil {
+			return nil, err
+		}
+	}
+	fs.changed(r.Filepath)
+	flags := r.Pflags()
+	if ref := fs.hostLookup(r.Filepath, true, true); ref != nil {
+		if fs.config.AtomicUploads() {
+			hostFile, err := fs.hostAtomicCreate(ref, flags.Trunc)
+			if err != nil {
+				ref.Close()
+				return nil, err
+			}
+			hostFile.file = fs.createDockerFile(r.Filepath, false, fs.containerID)
+			fs.startUpload(hostFile.file, hostFile)
+			return hostFile, nil
+		}
+		defer ref.Close()
+		hostFile, err := fs.hostFileCreate(ref, flags.Trunc)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedFile{File: hostFile, file: fs.createDockerFile(r.Filepath, false, fs.containerID)}, nil
+	}
 	file, err := fs.fetch(r.Filepath)
+	exists := err == nil
 
 	if err == os.ErrNotExist {
 		dir, err := fs.fetch(filepath.Dir(r.Filepath))
 		if err != nil {
-			parentFolderName := filepath.Base(filepath.Dir(r.Filepath))
-			parentFolderPath := filepath.Dir(filepath.Dir(r.Filepath))
-			parentDir := fs.createDockerFile(parentFolderPath, true, fs.containerID)
-			err := parentDir.execMkDir(parentFolderName)
+			err := fs.execMkDir(filepath.Dir(r.Filepath), true)
 			if err != nil {
 				return nil, os.ErrInvalid
 			}
@@ -75,47 +126,97 @@ func (fs *root) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 			return nil, os.ErrInvalid
 		}
 		file = fs.createDockerFile(r.Filepath, false, fs.containerID)
-	} else {
-		file.content = nil
+	} else if err != nil {
+		return nil, err
+	} else if file.isdir {
+		return nil, os.ErrInvalid
+	}
+	// Atomic uploads of existing content need the spool to copy the content.
+	if a := fs.agent(); a != nil && (!fs.config.AtomicUploads() || !exists || flags.Trunc) {
+		w, err := fs.newAgentWriter(a, file, flags, exists)
+		if err == nil && w.path != file.name {
+			fs.startUpload(file, w)
+		}
+		return w, err
 	}
-	return file, nil
+	w, err := fs.newSpoolWriter(file, flags, exists)
+	if err == nil {
+		fs.startUpload(file, w)
+		if fs.batch != nil {
+			fs.batch.opened(w)
+		}
+	}
+	return w, err
 }
-func oct(i int, prefix bool) string {
-	i64 := int64(i)
 
-	if prefix {
-		return "0o" + strconv.FormatInt(i64, 8) // base 8 for octal
-	} else {
-		return strconv.FormatInt(i64, 8) // base 8 for octal
+// Filecmd handles all file commands. Errors are mapped to sftp status codes.
+// The changed paths are dropped from the caches of the other sessions.
+func (fs *root) Filecmd(r *sftp.Request) error {
+	err := sftpError(fs.filecmd(r))
+	fs.auditCmd(r, err)
+	if err != nil {
+		return err
 	}
+	fs.changed(r.Filepath)
+	if r.Target != "" {
+		fs.changed(r.Target)
+	}
+	return nil
 }
-func (fs *root) Filecmd(r *sftp.Request) error {
-	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
+
+// auditCmd writes the audit entry of a file command.
+func (fs *root) auditCmd(r *sftp.Request, err error) {
+	name, target := r.Filepath, r.Target
+	if r.Method == "Symlink" || r.Method == "Link" {
+		// The new link is the changed path.
+		name, target = r.Target, r.Filepath
+	}
+	fs.config.Audit(strings.ToLower(r.Method), name, target, 0, err)
+}
+
+// sftpError maps errors of file operations, including the error output of execs, to sftp status codes.
+func sftpError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return sftp.ErrSSHFxNoSuchFile
+	}
+	if os.IsPermission(err) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "no such file or directory"):
+		return sftp.ErrSSHFxNoSuchFile
+	case strings.Contains(message, "permission denied"),
+		strings.Contains(message, "operation not permitted"),
+		strings.Contains(message, "read-only file system"):
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+func (fs *root) filecmd(r *sftp.Request) error {
+	defer fs.lockPaths(r.Filepath, r.Target)()
+	defer fs.execSlot()()
 	switch r.Method {
 	case "Setstat":
-		// CHMOD
-		attrFlags := r.AttrFlags()
-		if attrFlags.Permissions {
-			file, err := fs.fetch(r.Filepath)
-			if err != nil {
-				return err
-			}
-			fileStat := r.Attributes()
-			fileMode := fileStat.FileMode()
-			permissions := oct(int(fileMode), false)
-			return file.execFileChmod(string(permissions))
+		file, err := fs.fetch(r.Filepath)
+		if err != nil {
+			return err
 		}
-		if attrFlags.Size {
-			file, err := fs.fetch(r.Filepath)
-			if err != nil {
+		attrs := newFileAttrs(r)
+		if attrs.flags.Size {
+			if err := file.checkWrite(int64(attrs.size), 0); err != nil {
 				return err
 			}
-			fileStat := r.Attributes()
-			size := fileStat.Size
-			return file.execTruncate(size)
 		}
-		return nil
+		if upload := fs.upload(file); upload != nil {
+			// Applied to the upload before it replaces the file.
+			return upload.setstat(attrs)
+		}
+		return file.execSetstat(attrs)
 	case "Rename":
 		file, err := fs.fetch(r.Filepath)
 		if err != nil {
@@ -125,40 +226,54 @@ func (fs *root) Filecmd(r *sftp.Request) error {
 		if err != nil {
 			return err
 		}
-		fs.files[r.Target] = fs.files[r.Filepath]
-		delete(fs.files, r.Filepath)
-	case "Rmdir", "Remove":
-
+		fs.forget(r.Filepath)
+		fs.forget(r.Target)
+	case "Remove":
 		file, err := fs.fetch(r.Filepath)
 		if err != nil {
 			return err
 		}
-		go func() {
-			file.execRemove()
-		}()
-
-		file.deleted = true
-
-		// If it is a directory we need to clean up all subfiles/folders.
-		if file.IsDir() {
-			for path, descendantFile := range fs.files {
-				if strings.Contains(path+"/", file.name) {
-					descendantFile.deleted = true
-				}
-			}
+		if fs.useTrash(file.name) {
+			err = fs.execTrash(file, false)
+		} else {
+			err = file.execRemove()
+		}
+		if err != nil {
+			return err
+		}
+		fs.forget(file.name)
+	case "Rmdir":
+		file, err := fs.fetch(r.Filepath)
+		if err != nil {
+			return err
+		}
+		if fs.useTrash(file.name) {
+			err = fs.execTrash(file, true)
+		} else {
+			err = file.execRmdir()
 		}
+		if err != nil {
+			return err
+		}
+		fs.forget(file.name)
 	case "Mkdir":
-
-		folder := fs.createDockerFile(filepath.Dir(r.Filepath), true, fs.containerID)
-		go func() {
-			err := folder.execMkDir(filepath.Base(r.Filepath))
-			if err != nil {
-				log.Errorf(err.Error())
-			}
-		}()
-		fs.createDockerFile(r.Filepath, true, folder.containerID)
+		if err := fs.execMkDir(r.Filepath, false); err != nil {
+			return err
+		}
+		// Fetched with the real metadata on the next access.
+		fs.forget(r.Filepath)
+	case "Link":
+		// Hardlink of the request server. Filepath is the existing file, Target the new link.
+		if err := fs.execLink(r.Filepath, r.Target); err != nil {
+			return err
+		}
+		fs.forget(r.Target)
 	case "Symlink":
-		// Not implemented
+		// The request server passes the target as Filepath and the new link as Target.
+		if err := fs.execSymlink(r.Filepath, r.Target); err != nil {
+			return err
+		}
+		fs.forget(r.Target)
 	}
 	return nil
 }
@@ -179,11 +294,12 @@ func (f listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
 }
 
 func (fs *root) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
-
 	path := r.Filepath
 	if r.Filepath == "/" {
 		path = fs.dockerFile.name
 	}
+	defer fs.lockPaths(path)()
+	defer fs.execSlot()()
 
 	switch r.Method {
 	case "List":
@@ -195,6 +311,17 @@ func (fs *root) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 
 		return listerat(list), err
 	case "Stat":
+		// Request servers which don't distinguish Lstat send it as Stat as well.
+		file, err := fs.fetch(path)
+		if err != nil {
+			return nil, err
+		}
+		file, err = fs.execFollow(file)
+		if err != nil {
+			return nil, err
+		}
+		return listerat([]os.FileInfo{file}), nil
+	case "Lstat":
 		file, err := fs.fetch(path)
 		if err != nil {
 			return nil, err
@@ -205,13 +332,11 @@ func (fs *root) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		if err != nil {
 			return nil, err
 		}
-		if file.symlink != "" {
-			file, err = fs.fetch(file.symlink)
-			if err != nil {
-				return nil, err
-			}
+		target, err := fs.execReadlink(file)
+		if err != nil {
+			return nil, err
 		}
-		return listerat([]os.FileInfo{file}), nil
+		return listerat([]os.FileInfo{linkTarget{FileInfo: file, target: target}}), nil
 	}
 	return nil, nil
 }
@@ -221,62 +346,126 @@ type root struct {
 	*dockerFile
 	files       map[string]*dockerFile
 	containerID string
-	filesLock   sync.Mutex
-	config ssh2docksal.Config
+	// session identifies the changes of the session in the change log.
+	session uint64
+	// filesLock guards files, changeSeq and the uploads of the cached files.
+	filesLock sync.Mutex
+	// locks serializes requests on the same path.
+	locks pathLocks
+	// execSlots limits the requests talking to docker at the same time.
+	execOnce   sync.Once
+	execSlots  chan struct{}
+	config     ssh2docksal.Config
+	mounts     []hostMount
+	userLock   sync.Mutex
+	uid        int
+	gid        int
+	userLoaded bool
+	// changeSeq is the last change of other sessions dropped from the cache.
+	changeSeq uint64
+	// listings holds the prefetched folders, walkRoot and walkLists track walks of the client.
+	listings  map[string]*listing
+	walkRoot  string
+	walkLists int
+	// batch commits the closed uploads of the session together, nil if disabled.
+	batch *uploadBatch
+	// hooks runs the upload hooks of the session, nil if there are none.
+	hooks *uploadHooks
+	// trashEntry is the trash entry of the removals of the session, created by the first one.
+	// trashItems counts the removals in it.
+	trashLock  sync.Mutex
+	trashEntry string
+	trashItems int
+	// quota tracks the writes of the session for the upload limits.
+	quota uploadQuota
+}
+
+// agent returns the agent of the container or nil if it is not available.
+func (fs *root) agent() *agentClient {
+	return getAgent(fs.containerID, fs.config)
+}
+
+// newFileMode returns the permissions of new files.
+func (fs *root) newFileMode() os.FileMode {
+	return 0666 &^ fs.config.GetUmask()
+}
+
+// newDirMode returns the permissions of new folders.
+func (fs *root) newDirMode() os.FileMode {
+	return 0777 &^ fs.config.GetUmask()
+}
+
+// execUser returns the uid and gid of the docker user or -1 if they are unknown.
+func (fs *root) execUser() (int, int) {
+	fs.userLock.Lock()
+	defer fs.userLock.Unlock()
+	if !fs.userLoaded {
+		uid, gid, err := execUserIDs(fs.containerID, fs.config.DockerUser)
+		if err != nil {
+			log.Warnf("SFTP: Unable to lookup user %s: %s", fs.config.DockerUser, err.Error())
+			uid, gid = -1, -1
+		}
+		fs.uid, fs.gid, fs.userLoaded = uid, gid, true
+	}
+	return fs.uid, fs.gid
+}
+
+// forget drops path and everything below it from the cache. Files with an open upload are kept.
+func (fs *root) forget(path string) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	fs.forgetLocked(path)
+}
+
+func (fs *root) forgetLocked(path string) {
+	fs.forgetListingsLocked(path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for name, file := range fs.files {
+		if file.upload == nil && (name == path || strings.HasPrefix(name, prefix)) {
+			delete(fs.files, name)
+		}
+	}
 }
 
 func (fs *root) fetch(path string) (*dockerFile, error) {
 	if path == "/" {
 		return fs.dockerFile, nil
 	}
-	if file, ok := fs.files[path]; ok {
-		if file.deleted == true {
+	if file := fs.cached(path); file != nil {
+		return file, nil
+	}
+	if file, ok := fs.prefetched(path); ok {
+		if file == nil {
 			return nil, os.ErrNotExist
 		}
-		return file, nil
+		return fs.cache(path, file), nil
 	}
 
 	file, err := fs.execFileInfo(path)
 	if err != nil {
 		return nil, err
 	}
-	fs.files[path] = file
-	return file, nil
+	return fs.cache(path, file), nil
 }
 
 // Implements os.FileInfo, Reader and Writer interfaces.
 // These are the 3 interfaces necessary for the Handlers.
 type dockerFile struct {
-	name        string
-	modtime     time.Time
+	name    string
+	modtime time.Time
+	// fetched is the time the metadata was cached.
+	fetched     time.Time
 	symlink     string
-	size        string
+	size        int64
+	mode        os.FileMode
+	uid         uint32
+	gid         uint32
+	hasStat     bool
 	isdir       bool
-	content     []byte
-	contentLock sync.RWMutex
 	containerID string
-	deleted     bool
-	root 		root
-}
-
-func createNewDockerFile(lsString string, containerID string) (*dockerFile, error) {
-	//lsString = strings.Replace(lsString, "  ", " ", -1)
-	parts := strings.Fields(lsString)
-	isDirString := parts[0][0:1]
-	isDir := false
-	nameIdentifier := 8
-	if isDirString == "d" {
-		isDir = true
-		nameIdentifier = 8
-	}
-	size := parts[4]
-	name := strings.Join(parts[nameIdentifier:len(parts)], " ")
-	if strings.Index(name, " ") != -1 {
-		name = name + ""
-	}
-	file := newDockerFile(name, isDir, containerID)
-	file.size = size
-	return file, nil
+	root        *root
+	// upload is an open upload which is not visible at the path yet.
+	upload pendingUpload
 }
 
 // factory to make sure modtime is set
@@ -286,14 +475,16 @@ func newDockerFile(name string, isdir bool, containerID string) *dockerFile {
 		modtime:     time.Now(),
 		isdir:       isdir,
 		containerID: containerID,
-
 	}
 }
 
 // Have dockerFile fulfill os.FileInfo interface
 func (f *dockerFile) Name() string { return filepath.Base(f.name) }
-func (f *dockerFile) Size() int64  { return int64(len(f.content)) }
+func (f *dockerFile) Size() int64  { return f.size }
 func (f *dockerFile) Mode() os.FileMode {
+	if f.hasStat {
+		return f.mode
+	}
 	ret := os.FileMode(0644)
 	if f.isdir {
 		ret = os.FileMode(0755) | os.ModeDir
@@ -306,69 +497,8 @@ func (f *dockerFile) Mode() os.FileMode {
 func (f *dockerFile) ModTime() time.Time { return f.modtime }
 func (f *dockerFile) IsDir() bool        { return f.isdir }
 func (f *dockerFile) Sys() interface{} {
-	return nil
-}
-
-// Read/Write
-func (f *dockerFile) ReaderAt() (io.ReaderAt, error) {
-
-	if f.isdir {
-		return nil, os.ErrInvalid
-	}
-	return bytes.NewReader(f.content), nil
-}
-
-func (f *dockerFile) WriteAt(p []byte, off int64) (int, error) {
-	log.Debugf("Upload file: %s", f.name)
-	f.contentLock.Lock()
-	plen := len(p) + int(off)
-	if plen >= len(f.content) {
-		nc := make([]byte, plen)
-		copy(nc, f.content)
-		f.content = nc
-	}
-	copy(f.content[off:], p)
-
-	// Check if bytes where transfered.
-	// Otherwise a simple touch is more performant.
-	if len(p) != 0 {
-		// Here starts the tricky part.
-		// The docker api only supports tar upload.
-		// Right now there seems no other way as uploading the complete file each time.
-		// First create tmp folder.
-		tmpDirPath, err := ioutil.TempDir("", "ssh2docksal")
-		tmpFilePath := tmpDirPath + "/" + f.Name()
-		tmpTarPath := tmpFilePath + ".tar"
-		// Create tmp file with the correct file name.
-		tmpFile, err := os.Create(tmpFilePath)
-		_, err = tmpFile.Write(f.content)
-		if err != nil {
-			return 0, err
-		}
-		// than create archive file
-		err = archiver.Archive([]string{tmpFilePath}, tmpTarPath)
-		if err != nil {
-			return 0, err
-		}
-		// Last .. upload the file.
-		tarFile, err := os.Open(tmpTarPath)
-		if err != nil {
-			return 0, err
-		}
-		err = f.execFileUpload(tarFile)
-
-		// Cleanup the tmp folder.
-		go func() {
-			os.Remove(tmpDirPath)
-		}()
-
-
-	} else {
-		err := f.execFileCreate()
-		if err != nil {
-			return 0, err
-		}
+	if f.hasStat {
+		return &syscall.Stat_t{Uid: f.uid, Gid: f.gid}
 	}
-	defer f.contentLock.Unlock()
-	return len(p), nil
+	return nil
 }
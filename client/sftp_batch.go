@@ -0,0 +1,211 @@
+package client
+
+// Batched commits of spooled uploads. Deploying many small files costs a
+// CopyToContainer call per file. Closed uploads of a session are collected
+// for Config.SftpUploadBatch and extracted from a single tar stream. The batch
+// is committed early if the session has no other open uploads, so clients
+// uploading one file after the other don't wait for the window.
+//
+// Close returns before the commit. The sftp channel holds the close response
+// until the result of the file is known and turns it into an error status if
+// the commit failed.
+
+import (
+	"fmt"
+	"github.com/apex/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatchFiles is the maximum number of files committed together.
+	maxBatchFiles = 256
+	// maxBatchSize is the maximum size of the files committed together.
+	maxBatchSize = 32 << 20
+)
+
+// moveScript moves the atomic uploads given as pairs of temp name and target.
+// The targets which failed are printed NUL terminated.
+const moveScript = `while [ $# -gt 1 ]; do
+	mv -f -- "$1" "$2" 2>/dev/null || { rm -f -- "$1"; printf '%s\0' "$2"; }
+	shift 2
+done`
+
+// uploadBatch collects the closed uploads of a session.
+type uploadBatch struct {
+	fs     *root
+	window time.Duration
+	lock   sync.Mutex
+	// open is the number of batched uploads which are not closed yet.
+	open    int
+	pending []*batchEntry
+	size    int64
+	timer   *time.Timer
+	// waiting holds the closed uploads per path until the close response is sent.
+	waiting map[string][]*batchEntry
+	// commitLock keeps the order of the batches.
+	commitLock sync.Mutex
+}
+
+type batchEntry struct {
+	w    *spoolWriter
+	err  error
+	done chan struct{}
+}
+
+func newUploadBatch(fs *root, window time.Duration) *uploadBatch {
+	return &uploadBatch{fs: fs, window: window, waiting: make(map[string][]*batchEntry)}
+}
+
+// opened registers a new upload of the batch.
+func (b *uploadBatch) opened(w *spoolWriter) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	w.batch = b
+	b.open++
+}
+
+// add queues a closed upload. The caller holds the lock of w.
+func (b *uploadBatch) add(w *spoolWriter) {
+	entry := &batchEntry{w: w, done: make(chan struct{})}
+	b.lock.Lock()
+	b.open--
+	b.waiting[w.file.name] = append(b.waiting[w.file.name], entry)
+	if w.failed || !w.dirty {
+		b.lock.Unlock()
+		if w.failed {
+			log.Warnf("SFTP: Upload of %s was interrupted", w.file.name)
+		}
+		entry.finish(nil)
+		return
+	}
+	b.pending = append(b.pending, entry)
+	if stat, err := w.spool.Stat(); err == nil {
+		b.size += stat.Size()
+	}
+	flush := b.open <= 0 || len(b.pending) >= maxBatchFiles || b.size >= maxBatchSize
+	if !flush && b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.lock.Unlock()
+	if flush {
+		go b.flush()
+	}
+}
+
+// wait returns the commit result of the oldest closed upload of path. ok is
+// false if no upload of path was closed.
+func (b *uploadBatch) wait(path string) (ok bool, err error) {
+	b.lock.Lock()
+	entries := b.waiting[path]
+	if len(entries) == 0 {
+		b.lock.Unlock()
+		return false, nil
+	}
+	entry := entries[0]
+	if len(entries) == 1 {
+		delete(b.waiting, path)
+	} else {
+		b.waiting[path] = entries[1:]
+	}
+	b.lock.Unlock()
+	<-entry.done
+	return true, entry.err
+}
+
+// flush commits the pending uploads.
+func (b *uploadBatch) flush() {
+	b.commitLock.Lock()
+	defer b.commitLock.Unlock()
+	b.lock.Lock()
+	entries := b.pending
+	b.pending, b.size = nil, 0
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.lock.Unlock()
+	if len(entries) > 0 {
+		b.commit(entries)
+	}
+}
+
+// commit uploads the entries with a single tar stream. If that fails the files
+// are committed one by one to report the files which fail.
+func (b *uploadBatch) commit(entries []*batchEntry) {
+	defer b.fs.execSlot()()
+	if len(entries) == 1 {
+		entries[0].finish(entries[0].w.commit())
+		return
+	}
+	uploads := make([]*spoolUpload, 0, len(entries))
+	prepared := make([]*batchEntry, 0, len(entries))
+	for _, entry := range entries {
+		upload, err := entry.w.prepare()
+		if err != nil {
+			entry.finish(err)
+			continue
+		}
+		uploads = append(uploads, upload)
+		prepared = append(prepared, entry)
+	}
+	log.Debugf("SFTP: Upload %d files in one batch", len(uploads))
+	errs, err := b.fs.execBatchUpload(uploads)
+	if err != nil {
+		log.Warnf("SFTP: Batch upload failed, uploading the files one by one: %s", err.Error())
+		for _, entry := range prepared {
+			entry.finish(entry.w.commit())
+		}
+		return
+	}
+	for i, entry := range prepared {
+		if errs[i] == nil {
+			uploads[i].done()
+		}
+		entry.finish(errs[i])
+	}
+}
+
+func (entry *batchEntry) finish(err error) {
+	entry.err = err
+	entry.w.discard()
+	close(entry.done)
+}
+
+// execBatchUpload extracts the uploads in the container and moves atomic
+// uploads to their target. Returns the errors of the single files.
+func (fs *root) execBatchUpload(uploads []*spoolUpload) ([]error, error) {
+	archive := archiveUploads(uploads, "/")
+	err := execArchiveUpload(fs.containerID, "/", archive)
+	archive.CloseWithError(err)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(uploads))
+	cmd := []string{"sh", "-c", moveScript, "sh"}
+	for _, upload := range uploads {
+		if upload.w.atomic {
+			cmd = append(cmd, upload.target, upload.w.file.name)
+		}
+	}
+	if len(cmd) == 4 {
+		return errs, nil
+	}
+	output, err := outputExecCmd(fs.containerID, cmd, fs.config.DockerUser)
+	failed := map[string]bool{}
+	for _, name := range strings.Split(strings.TrimSuffix(output, "\x00"), "\x00") {
+		failed[name] = true
+	}
+	for i, upload := range uploads {
+		if !upload.w.atomic {
+			continue
+		}
+		if err != nil {
+			errs[i] = err
+		} else if failed[upload.w.file.name] {
+			errs[i] = fmt.Errorf("Unable to replace %s", upload.w.file.name)
+		}
+	}
+	return errs, nil
+}
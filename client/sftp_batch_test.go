@@ -0,0 +1,94 @@
+package client
+
+import (
+	"archive/tar"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, name string, content string) *spoolWriter {
+	spool, err := ioutil.TempFile("", "ssh2docksal-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.WriteString(content)
+	file := newDockerFile(name, false, "container")
+	file.root = &root{userLoaded: true, uid: -1, gid: -1}
+	return &spoolWriter{file: file, spool: spool, mode: 0644, uid: -1, gid: -1}
+}
+
+func TestArchiveUploads(t *testing.T) {
+	a := newTestSpool(t, "/var/www/a.txt", "a")
+	b := newTestSpool(t, "/var/www/sites/b.txt", "bb")
+	b.atomic = true
+	defer a.discard()
+	defer b.discard()
+	var uploads []*spoolUpload
+	for _, w := range []*spoolWriter{a, b} {
+		upload, err := w.prepare()
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploads = append(uploads, upload)
+	}
+
+	tr := tar.NewReader(archiveUploads(uploads, "/"))
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if int64(len(content)) != header.Size {
+			t.Errorf("Unexpected content %q of %s", content, header.Name)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 2 || names[0] != "var/www/a.txt" || names[1] != strings.TrimPrefix(uploads[1].target, "/") {
+		t.Errorf("Unexpected names %q", names)
+	}
+
+	header, err := tar.NewReader(archiveUploads(uploads[:1], "/var/www")).Next()
+	if err != nil || header.Name != "a.txt" {
+		t.Errorf("Expected the base name for single uploads, got %v %v", header, err)
+	}
+}
+
+func TestUploadBatch(t *testing.T) {
+	fs := &root{files: make(map[string]*dockerFile)}
+	batch := newUploadBatch(fs, time.Hour)
+
+	w := newTestSpool(t, "/var/www/a.txt", "a")
+	w.file.root = fs
+	batch.opened(w)
+	w.Close()
+	if _, err := os.Stat(w.spool.Name()); !os.IsNotExist(err) {
+		t.Errorf("Expected unchanged uploads to be done on close")
+	}
+	if ok, err := batch.wait("/var/www/a.txt"); !ok || err != nil {
+		t.Errorf("Expected the result of the upload, got %v %v", ok, err)
+	}
+	if ok, _ := batch.wait("/var/www/a.txt"); ok {
+		t.Errorf("Expected the result to be reported once")
+	}
+
+	c := fs.SftpChannel(nil).(*extensionChannel)
+	c.fs.batch = batch
+	failed := &batchEntry{w: newTestSpool(t, "/var/www/b.txt", "b"), err: errors.New("Upload failed"), done: make(chan struct{})}
+	failed.finish(failed.err)
+	batch.waiting["/var/www/b.txt"] = []*batchEntry{failed}
+	c.closes[7] = "/var/www/b.txt"
+	data := &packetData{b: c.closed(statusPacket(7, nil))[1:]}
+	if id, code := data.uint32(), data.uint32(); id != 7 || code != fxFailure {
+		t.Errorf("Expected the close to fail, got id %d code %d", id, code)
+	}
+	data = &packetData{b: c.closed(statusPacket(8, nil))[1:]}
+	if id, code := data.uint32(), data.uint32(); id != 8 || code != fxOK {
+		t.Errorf("Expected other responses to pass, got id %d code %d", id, code)
+	}
+}
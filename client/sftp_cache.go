@@ -0,0 +1,167 @@
+package client
+
+// Metadata cache of the sftp sessions. Cached files expire after
+// Config.SftpCacheTTL, the number of files is bounded by Config.SftpCacheSize.
+// Paths changed by a session are dropped from the caches of the other sessions.
+// Scp uploads and exec sessions change paths outside of any sftp session.
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxChanges is the number of changes kept for the other sessions. Sessions
+// which missed changes drop their whole cache.
+const maxChanges = 4096
+
+// noSession is the origin of changes made outside of the sftp sessions.
+const noSession = 0
+
+type pathChange struct {
+	seq         uint64
+	containerID string
+	path        string
+	origin      uint64
+}
+
+// sessionSeq numbers the sftp sessions.
+var sessionSeq uint64
+
+// newSessionID returns the id of a new sftp session.
+func newSessionID() uint64 {
+	return atomic.AddUint64(&sessionSeq, 1)
+}
+
+// changeLog records the paths changed by all sftp sessions.
+var changeLog = struct {
+	sync.Mutex
+	seq     uint64
+	changes []pathChange
+}{}
+
+// recordChange marks path of the container as changed by the session origin.
+// Changes made outside of the sftp sessions use noSession.
+func recordChange(containerID string, path string, origin uint64) {
+	changeLog.Lock()
+	defer changeLog.Unlock()
+	changeLog.seq++
+	changeLog.changes = append(changeLog.changes, pathChange{seq: changeLog.seq, containerID: containerID, path: path, origin: origin})
+	if len(changeLog.changes) > maxChanges {
+		changeLog.changes = append(changeLog.changes[:0:0], changeLog.changes[len(changeLog.changes)-maxChanges:]...)
+	}
+}
+
+// containerChanged drops the container from the caches of all sftp sessions,
+// after exec sessions which may have changed any path.
+func containerChanged(containerID string) {
+	recordChange(containerID, "/", noSession)
+}
+
+// changedPaths returns the paths of the container changed by other sessions
+// after seq. all is set if changes were missed.
+func changedPaths(containerID string, seq uint64, session uint64) (paths []string, all bool, last uint64) {
+	changeLog.Lock()
+	defer changeLog.Unlock()
+	if seq == changeLog.seq {
+		return nil, false, seq
+	}
+	if len(changeLog.changes) == 0 || changeLog.changes[0].seq > seq+1 {
+		return nil, true, changeLog.seq
+	}
+	for _, change := range changeLog.changes[seq+1-changeLog.changes[0].seq:] {
+		if change.containerID == containerID && change.origin != session {
+			paths = append(paths, change.path)
+		}
+	}
+	return paths, false, changeLog.seq
+}
+
+// changed marks path as changed for the other sessions. The prefetched
+// listings of path are dropped.
+func (fs *root) changed(path string) {
+	recordChange(fs.containerID, path, fs.session)
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	fs.forgetListingsLocked(path)
+}
+
+// expireChanges drops the paths changed by other sessions from the cache.
+func (fs *root) expireChanges() {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	fs.expireChangesLocked()
+}
+
+func (fs *root) expireChangesLocked() {
+	paths, all, last := changedPaths(fs.containerID, fs.changeSeq, fs.session)
+	fs.changeSeq = last
+	if all {
+		fs.forgetLocked("/")
+		return
+	}
+	for _, path := range paths {
+		fs.forgetLocked(path)
+	}
+}
+
+// cached returns the cached file of path or nil if it is missing or expired.
+func (fs *root) cached(path string) *dockerFile {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	fs.expireChangesLocked()
+	if file, ok := fs.files[path]; ok && fs.fresh(file) {
+		return file
+	}
+	return nil
+}
+
+// cache adds file to the cache. The oldest files are dropped if the cache is full.
+// Files with an open upload are not replaced, the cached file is returned instead.
+func (fs *root) cache(path string, file *dockerFile) *dockerFile {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	if cached, ok := fs.files[path]; ok && cached.upload != nil {
+		return cached
+	}
+	file.root = fs
+	file.fetched = time.Now()
+	fs.files[path] = file
+	if size := fs.config.GetSftpCacheSize(); len(fs.files) > size {
+		fs.evict(size - size/10)
+	}
+	return file
+}
+
+// fresh checks if the cached metadata of file is still valid.
+func (fs *root) fresh(file *dockerFile) bool {
+	return file.upload != nil || time.Since(file.fetched) < fs.config.SftpCacheTTL
+}
+
+// evict drops expired files and then the oldest files until size files are left.
+// Files with an open upload are kept. The caller holds filesLock.
+func (fs *root) evict(size int) {
+	names := make([]string, 0, len(fs.files))
+	for name, file := range fs.files {
+		if fs.fresh(file) {
+			if file.upload == nil {
+				names = append(names, name)
+			}
+			continue
+		}
+		delete(fs.files, name)
+	}
+	if len(fs.files) <= size {
+		return
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return fs.files[names[i]].fetched.Before(fs.files[names[j]].fetched)
+	})
+	for _, name := range names {
+		if len(fs.files) <= size {
+			break
+		}
+		delete(fs.files, name)
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"github.com/andock/ssh2docksal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCacheRoot(dir string, ttl time.Duration, size int) *root {
+	fs := &root{
+		files:       make(map[string]*dockerFile),
+		containerID: "cache-" + dir,
+		session:     newSessionID(),
+		config:      ssh2docksal.Config{SftpCacheTTL: ttl, SftpCacheSize: size},
+		mounts:      []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded:  true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+	fs.dockerFile = newDockerFile("/", true, fs.containerID)
+	fs.dockerFile.root = fs
+	fs.expireChanges()
+	return fs
+}
+
+func TestCacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	fs := newCacheRoot(dir, time.Hour, 0)
+	first, err := fs.fetch("/var/www/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644)
+	if file, _ := fs.fetch("/var/www/a.txt"); file != first {
+		t.Errorf("Expected the cached file within the TTL")
+	}
+	first.fetched = time.Now().Add(-2 * time.Hour)
+	if file, _ := fs.fetch("/var/www/a.txt"); file == first || file.Size() != 7 {
+		t.Errorf("Expected expired files to be fetched again")
+	}
+
+	fs = newCacheRoot(dir, 0, 0)
+	first, _ = fs.fetch("/var/www/a.txt")
+	if file, _ := fs.fetch("/var/www/a.txt"); file == first {
+		t.Errorf("Expected no caching with a TTL of 0")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	fs := newCacheRoot("/tmp", time.Hour, 10)
+	upload := newDockerFile("/var/www/upload.txt", false, fs.containerID)
+	upload.upload = &spoolWriter{}
+	fs.cache(upload.name, upload)
+	for i := 0; i < 20; i++ {
+		name := filepath.Join("/var/www", string(rune('a'+i)))
+		fs.cache(name, newDockerFile(name, false, fs.containerID))
+	}
+	if len(fs.files) > 10 {
+		t.Errorf("Expected at most 10 cached files, got %d", len(fs.files))
+	}
+	if fs.files[upload.name] != upload {
+		t.Errorf("Expected files with an open upload to be kept")
+	}
+	if _, ok := fs.files["/var/www/t"]; !ok {
+		t.Errorf("Expected the newest file to be kept")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+
+	fs1 := newCacheRoot(dir, time.Hour, 0)
+	fs2 := newCacheRoot(dir, time.Hour, 0)
+	a1, _ := fs1.fetch("/var/www/a.txt")
+	b1, _ := fs1.fetch("/var/www/b.txt")
+	a2, _ := fs2.fetch("/var/www/a.txt")
+
+	fs2.changed("/var/www/a.txt")
+	if file, _ := fs1.fetch("/var/www/a.txt"); file == a1 {
+		t.Errorf("Expected paths changed by other sessions to be fetched again")
+	}
+	if file, _ := fs1.fetch("/var/www/b.txt"); file != b1 {
+		t.Errorf("Expected unchanged paths to stay cached")
+	}
+	if file, _ := fs2.fetch("/var/www/a.txt"); file != a2 {
+		t.Errorf("Expected own changes to keep the cache")
+	}
+
+	b1, _ = fs1.fetch("/var/www/b.txt")
+	b2, _ := fs2.fetch("/var/www/b.txt")
+	containerChanged(fs1.containerID)
+	if file, _ := fs1.fetch("/var/www/b.txt"); file == b1 {
+		t.Errorf("Expected exec sessions to drop the whole cache")
+	}
+	if file, _ := fs2.fetch("/var/www/b.txt"); file == b2 {
+		t.Errorf("Expected exec sessions to drop the whole cache of every session")
+	}
+
+	b1, _ = fs1.fetch("/var/www/b.txt")
+	for i := 0; i <= maxChanges; i++ {
+		recordChange("other", "/var/www/c.txt", noSession)
+	}
+	if file, _ := fs1.fetch("/var/www/b.txt"); file == b1 {
+		t.Errorf("Expected missed changes to drop the whole cache")
+	}
+}
@@ -2,28 +2,39 @@ package client
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"golang.org/x/net/context"
+	"io"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func simpleExec(containerID string, command string, dockerUser string) error {
-	_, err := outpuExec(containerID, command, dockerUser)
+// simpleExec runs cmd as argv. File names must never be formatted into a shell command.
+func simpleExec(containerID string, cmd []string, dockerUser string) error {
+	_, err := outpuExec(containerID, cmd, dockerUser)
 	return err
 }
 
-func outpuExec(containerID string, command string, dockerUser string) (string, error) {
+func outpuExec(containerID string, cmd []string, dockerUser string) (string, error) {
+	output, err := outputExecCmd(containerID, cmd, dockerUser)
+	return strings.TrimSpace(output), err
+}
+
+// outputExecCmd runs cmd without a shell and returns the untouched output.
+func outputExecCmd(containerID string, cmd []string, dockerUser string) (string, error) {
+	command := strings.Join(cmd, " ")
 	log.Debugf("SFTP: Execute command: %s", command)
 	cli, err := client.NewEnvClient()
-	args := []string{"bash", "-c", command}
 	if err != nil {
 		return "", err
 	}
-	execConfig := types.ExecConfig{Tty: false, AttachStdout: true, AttachStderr: true, Cmd: args, User: dockerUser}
+	execConfig := types.ExecConfig{Tty: false, AttachStdout: true, AttachStderr: true, Cmd: cmd, User: dockerUser}
 	respIdExecCreate, err := cli.ContainerExecCreate(context.Background(), containerID, execConfig)
 	if err != nil {
 		return "", err
@@ -33,18 +44,115 @@ func outpuExec(containerID string, command string, dockerUser string) (string, e
 	if err != nil {
 		log.Errorf("Unable to execute %s", command)
 		log.WithError(err)
+		return "", err
 	}
+	defer connection.Close()
 	connection.CloseWrite()
 	stdoutput := new(bytes.Buffer)
 	stderror := new(bytes.Buffer)
 	stdcopy.StdCopy(stdoutput, stderror, connection.Reader)
-	output := strings.TrimSpace(stdoutput.String())
 	errorString := stderror.String()
 	if errorString != "" {
-		err := fmt.Errorf(errorString)
+		err := errors.New(errorString)
 		log.Errorf("Unable to execute %s", command)
 		log.WithError(err)
 		return "", err
 	}
-	return output, nil
+	return stdoutput.String(), nil
+}
+
+// execUserIDs looks up the numeric uid and gid of the docker user.
+func execUserIDs(containerID string, dockerUser string) (int, int, error) {
+	output, err := outpuExec(containerID, []string{"sh", "-c", "id -u; id -g"}, dockerUser)
+	if err != nil {
+		return 0, 0, err
+	}
+	ids := strings.Fields(output)
+	if len(ids) != 2 {
+		return 0, 0, fmt.Errorf("Unexpected output of id: %s", output)
+	}
+	uid, err := strconv.Atoi(ids[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(ids[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// execStream is the stdout of a running exec.
+type execStream struct {
+	*io.PipeReader
+	conn io.Closer
+}
+
+func (s *execStream) Close() error {
+	s.PipeReader.Close()
+	return s.conn.Close()
+}
+
+// streamExecCmd runs cmd without a shell and streams its stdout. Output on stderr
+// is returned as error at the end of the stream.
+func streamExecCmd(containerID string, cmd []string, dockerUser string) (io.ReadCloser, error) {
+	log.Debugf("SFTP: Stream command: %s", strings.Join(cmd, " "))
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	execConfig := types.ExecConfig{Tty: false, AttachStdout: true, AttachStderr: true, Cmd: cmd, User: dockerUser}
+	respIdExecCreate, err := cli.ContainerExecCreate(context.Background(), containerID, execConfig)
+	if err != nil {
+		return nil, err
+	}
+	connection, err := cli.ContainerExecAttach(context.Background(), respIdExecCreate.ID, types.ExecConfig{})
+	if err != nil {
+		return nil, err
+	}
+	connection.CloseWrite()
+	reader, writer := io.Pipe()
+	go func() {
+		stderror := new(bytes.Buffer)
+		_, err := stdcopy.StdCopy(writer, stderror, connection.Reader)
+		if err == nil && stderror.Len() != 0 {
+			err = errors.New(strings.TrimSpace(stderror.String()))
+		}
+		writer.CloseWithError(err)
+	}()
+	return &execStream{PipeReader: reader, conn: connection.Conn}, nil
+}
+
+// commandExecCmd runs cmd without a shell and returns its combined output and exit code.
+func commandExecCmd(containerID string, cmd []string, dockerUser string) (string, int, error) {
+	log.Debugf("SFTP: Run command: %s", strings.Join(cmd, " "))
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return "", 0, err
+	}
+	execConfig := types.ExecConfig{Tty: false, AttachStdout: true, AttachStderr: true, Cmd: cmd, User: dockerUser}
+	respIdExecCreate, err := cli.ContainerExecCreate(context.Background(), containerID, execConfig)
+	if err != nil {
+		return "", 0, err
+	}
+	connection, err := cli.ContainerExecAttach(context.Background(), respIdExecCreate.ID, types.ExecConfig{})
+	if err != nil {
+		return "", 0, err
+	}
+	defer connection.Close()
+	connection.CloseWrite()
+	output := new(bytes.Buffer)
+	stdcopy.StdCopy(output, output, connection.Reader)
+	// The exec may still be running for a moment after its output ended.
+	for i := 0; i < 50; i++ {
+		inspect, err := cli.ContainerExecInspect(context.Background(), respIdExecCreate.ID)
+		if err != nil {
+			return output.String(), 0, err
+		}
+		if !inspect.Running {
+			return output.String(), inspect.ExitCode, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return output.String(), 0, fmt.Errorf("Command %s did not finish", strings.Join(cmd, " "))
 }
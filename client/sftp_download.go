@@ -0,0 +1,216 @@
+package client
+
+// Streams sftp downloads from the container instead of buffering whole files.
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"sync"
+)
+
+const (
+	// downloadReadAhead is the buffer size of the stream.
+	downloadReadAhead = 256 << 10
+	// downloadWindow is the amount of data kept behind the stream position
+	// to answer out of order requests of pipelining clients.
+	downloadWindow = 4 << 20
+	// downloadChunk is the maximum size read from the stream at once.
+	downloadChunk = 64 << 10
+	// downloadBacktrack starts new streams before the requested offset as the
+	// requests in flight may arrive out of order.
+	downloadBacktrack = 1 << 20
+)
+
+// streamReader reads a container file sequentially and keeps a bounded window
+// of the recent data. Reads far behind or ahead of the stream start a new
+// stream at the requested offset.
+type streamReader struct {
+	lock sync.Mutex
+	// openAt starts a stream at the given offset.
+	openAt func(off int64) (io.ReadCloser, error)
+	stream io.Closer
+	reader *bufio.Reader
+	// pos is the offset of the next byte of the stream.
+	pos int64
+	// window holds the data right before pos.
+	window []byte
+	eof    bool
+}
+
+func (r *streamReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for n < len(p) {
+		cur := off + int64(n)
+		start := r.pos - int64(len(r.window))
+		if r.reader != nil && cur >= start && cur < r.pos {
+			n += copy(p[n:], r.window[cur-start:])
+			continue
+		}
+		if r.reader != nil && r.eof && cur >= r.pos {
+			return n, io.EOF
+		}
+		if r.reader == nil || cur < start || cur > r.pos+downloadWindow {
+			streamStart := cur - downloadBacktrack
+			if streamStart < 0 {
+				streamStart = 0
+			}
+			if err := r.open(streamStart); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := r.advance(cur + 1); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// advance reads the stream until pos reaches target or the end of the file.
+func (r *streamReader) advance(target int64) error {
+	for r.pos < target && !r.eof {
+		size := downloadChunk
+		if len(r.window)+size > cap(r.window) {
+			// Drop the oldest data to keep the window bounded.
+			keep := downloadWindow - size
+			if keep > len(r.window) {
+				keep = len(r.window)
+			}
+			if cap(r.window) < downloadWindow {
+				window := make([]byte, keep, downloadWindow)
+				copy(window, r.window[len(r.window)-keep:])
+				r.window = window
+			} else {
+				r.window = r.window[:copy(r.window, r.window[len(r.window)-keep:])]
+			}
+		}
+		n, err := r.reader.Read(r.window[len(r.window) : len(r.window)+size])
+		r.window = r.window[:len(r.window)+n]
+		r.pos += int64(n)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			r.closeStream()
+			return err
+		}
+	}
+	return nil
+}
+
+// open starts a new stream at offset off.
+func (r *streamReader) open(off int64) error {
+	r.closeStream()
+	stream, err := r.openAt(off)
+	if err != nil {
+		return err
+	}
+	r.stream = stream
+	r.reader = bufio.NewReaderSize(stream, downloadReadAhead)
+	r.pos = off
+	r.window = r.window[:0]
+	r.eof = false
+	return nil
+}
+
+func (r *streamReader) closeStream() {
+	if r.stream != nil {
+		r.stream.Close()
+	}
+	r.stream = nil
+	r.reader = nil
+}
+
+// Close is called by the sftp request server after the transfer.
+func (r *streamReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeStream()
+	r.window = nil
+	return nil
+}
+
+// archiveFile is a file inside of a tar stream.
+type archiveFile struct {
+	io.Reader
+	io.Closer
+}
+
+// openContainerFile streams a container file from offset off. Ranged reads are done
+// with tail inside of the container, the archive api is the fallback.
+func openContainerFile(containerID string, filePath string, dockerUser string, off int64) (io.ReadCloser, error) {
+	if off > 0 {
+		stream, err := streamExecCmd(containerID, []string{"tail", "-c", "+" + strconv.FormatInt(off+1, 10), "--", filePath}, dockerUser)
+		if err == nil {
+			reader := bufio.NewReader(stream)
+			if _, err = reader.Peek(1); err == nil || err == io.EOF {
+				return archiveFile{Reader: reader, Closer: stream}, nil
+			}
+			stream.Close()
+		}
+		log.Debugf("SFTP: Ranged read of %s failed, falling back to the archive: %s", filePath, err.Error())
+	}
+	file, err := openArchiveFile(containerID, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, file, off); err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// openArchiveFile returns the content of a regular file from the archive api. Symlinks are followed.
+func openArchiveFile(containerID string, filePath string) (io.ReadCloser, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	for depth := 0; depth < maxScpLinkDepth; depth++ {
+		archive, _, err := cli.CopyFromContainer(context.Background(), containerID, filePath)
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(archive)
+		header, err := tr.Next()
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			return archiveFile{Reader: tr, Closer: archive}, nil
+		case tar.TypeSymlink:
+			archive.Close()
+			if path.IsAbs(header.Linkname) {
+				filePath = header.Linkname
+			} else {
+				filePath = path.Join(path.Dir(filePath), header.Linkname)
+			}
+		default:
+			archive.Close()
+			return nil, fmt.Errorf("%s is not a regular file", filePath)
+		}
+	}
+	return nil, fmt.Errorf("%s: Too many levels of symbolic links", filePath)
+}
+
+// execFileReader returns a streaming reader of the file content. Starting a
+// stream takes an exec slot of the session, running streams don't.
+func (file *dockerFile) execFileReader() *streamReader {
+	fs := file.root
+	return &streamReader{openAt: func(off int64) (io.ReadCloser, error) {
+		defer fs.execSlot()()
+		return openContainerFile(file.containerID, file.name, fs.config.DockerUser, off)
+	}}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestStreamReader(t *testing.T) {
+	content := make([]byte, 3*downloadWindow+12345)
+	rand.New(rand.NewSource(1)).Read(content)
+	opened := []int64{}
+	reader := &streamReader{openAt: func(off int64) (io.ReadCloser, error) {
+		opened = append(opened, off)
+		return ioutil.NopCloser(bytes.NewReader(content[off:])), nil
+	}}
+	defer reader.Close()
+
+	readAt := func(off int64, size int) {
+		p := make([]byte, size)
+		n, err := reader.ReadAt(p, off)
+		end := off + int64(size)
+		if end > int64(len(content)) {
+			end = int64(len(content))
+			if off > end {
+				off = end
+			}
+			if err != io.EOF {
+				t.Errorf("ReadAt(%d) at the end should return io.EOF, got %v", off, err)
+			}
+		} else if err != nil {
+			t.Errorf("ReadAt(%d): %s", off, err)
+		}
+		if !bytes.Equal(p[:n], content[off:end]) {
+			t.Errorf("ReadAt(%d) returned wrong data", off)
+		}
+	}
+
+	// Sequential reads with pipelined requests out of order.
+	const packet = 32 << 10
+	for off := int64(0); off < int64(len(content)); off += 2 * packet {
+		readAt(off+packet, packet)
+		readAt(off, packet)
+	}
+	if len(opened) != 1 {
+		t.Errorf("Sequential reads should use one stream, opened at %v", opened)
+	}
+	if cap(reader.window) > downloadWindow {
+		t.Errorf("Window should be bounded, got %d", cap(reader.window))
+	}
+
+	// Resume far behind the stream.
+	opened = opened[:0]
+	readAt(100, packet)
+	if len(opened) != 1 || opened[0] != 0 {
+		t.Errorf("Resume should open a stream at 0, opened at %v", opened)
+	}
+	// Jump far ahead.
+	opened = opened[:0]
+	readAt(2*downloadWindow+7, packet)
+	if len(opened) != 1 || opened[0] != 2*downloadWindow+7-downloadBacktrack {
+		t.Errorf("Jump should open a stream before the offset, opened at %v", opened)
+	}
+	// Small gaps are skipped in the stream, requests before the offset are served from the window.
+	opened = opened[:0]
+	readAt(2*downloadWindow+7+3*packet, packet)
+	readAt(2*downloadWindow+7-packet, packet)
+	if len(opened) != 0 {
+		t.Errorf("Small gaps should not open a stream, opened at %v", opened)
+	}
+
+	p := make([]byte, 10)
+	if n, err := reader.ReadAt(p, int64(len(content))+10); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt behind the end should return io.EOF, got %d %v", n, err)
+	}
+}
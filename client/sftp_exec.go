@@ -1,123 +1,209 @@
 package client
 
 import (
-	"archive/tar"
-	"fmt"
-	"github.com/apex/log"
+	"github.com/andock/ssh2docksal/agent"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"golang.org/x/net/context"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
+	"syscall"
 )
 
 func (folder *dockerFile) execFileList(fs *root) ([]os.FileInfo, error) {
 	folderName := folder.name
-
-	nameString, err := outpuExec(folder.containerID, "ls -al "+folderName, fs.config.DockerUser)
-	names := strings.Split(nameString, "\n")
-	validItems := []os.FileInfo{}
-	first := true
-	for _, fn := range names {
-		if first {
-			first = false
-			continue
-		}
-		item, _ := createNewDockerFile(fn, folder.containerID)
-		if item.name != "" && item.name != "." && item.name != ".." {
-			seperator := ""
-			if folderName != "/" {
-				seperator = "/"
+	if ref := fs.hostFile(folderName); ref != nil {
+		defer ref.Close()
+		return fs.hostFileList(folder, ref)
+	}
+	if a := fs.agent(); a != nil {
+		resp, err := a.call(&agent.Request{Op: agent.OpReadDir, Path: folderName})
+		if err != errAgentUnavailable {
+			if err != nil {
+				return nil, err
 			}
-			item.name = folderName + seperator + item.name
-			fs.files[item.name] = item
-			validItems = append(validItems, item)
+			validItems := []os.FileInfo{}
+			for i := range resp.Entries {
+				item := newAgentFile(folderName, &resp.Entries[i], folder.containerID)
+				fs.cache(item.name, item)
+				validItems = append(validItems, item)
+			}
+			return validItems, nil
 		}
 	}
 
-	return validItems, err
+	fs.prefetch(folderName)
+	if list := fs.prefetchedList(folderName); list != nil {
+		return list, nil
+	}
+	items, err := fs.execList(folderName)
+	if err != nil {
+		return nil, err
+	}
+	validItems := []os.FileInfo{}
+	for _, item := range items {
+		fs.cache(item.name, item)
+		validItems = append(validItems, item)
+	}
+	return validItems, nil
 }
 
-func (file *dockerFile) execFileUpload(tarFile *os.File) error {
-	cli, err := client.NewEnvClient()
-	err = cli.CopyToContainer(context.Background(), file.containerID, filepath.Dir(file.name), tarFile, types.CopyToContainerOptions{})
-	return err
+func (file *dockerFile) execFileUpload(tarFile io.Reader) error {
+	return execArchiveUpload(file.containerID, filepath.Dir(file.name), tarFile)
 }
 
-func (file *dockerFile) execFileDownload() error {
+// execArchiveUpload extracts a tar stream in folder of the container.
+func execArchiveUpload(containerID string, folder string, archive io.Reader) error {
 	cli, err := client.NewEnvClient()
 	if err != nil {
-		log.Errorf("Unable to download %s", file.containerID+":"+file.name)
-		log.WithError(err)
 		return err
 	}
-	reader, _, err := cli.CopyFromContainer(context.Background(), file.containerID, file.name)
-	tr := tar.NewReader(reader)
-	for {
-
-		_, err := tr.Next()
-		if err == io.EOF {
-			// end of tar archive
-			break
-		}
-		if err != nil {
-			log.WithError(err)
-			return err
-		}
+	return cli.CopyToContainer(context.Background(), containerID, folder, archive, types.CopyToContainerOptions{})
+}
 
-		bytes, err := ioutil.ReadAll(tr)
+func (file *dockerFile) execFileCreate() error {
+	if ref := file.root.hostLookup(file.name, true, true); ref != nil {
+		defer ref.Close()
+		hostFile, err := file.root.hostFileCreate(ref, false)
 		if err != nil {
-			log.WithError(err)
 			return err
 		}
-		file.content = bytes
+		return hostFile.Close()
 	}
-	return nil
-}
-
-func (file *dockerFile) execFileCreate() error {
-	return simpleExec(file.containerID, fmt.Sprintf("mkdir -p '%s'; cd '%s'; touch '%s'", filepath.Dir(file.name), filepath.Dir(file.name), file.Name()), file.root.config.DockerUser)
+	err := simpleExec(file.containerID, []string{"mkdir", "-p", "--", filepath.Dir(file.name)}, file.root.config.DockerUser)
+	if err != nil {
+		return err
+	}
+	return simpleExec(file.containerID, []string{"touch", "--", file.name}, file.root.config.DockerUser)
 }
 
 func (fs *root) execFileInfo(fileName string) (*dockerFile, error) {
-	output, err := outpuExec(fs.containerID, fmt.Sprintf("if [ -e '%s' ]; then ls -ald '%s'; fi", fileName, fileName), fs.config.DockerUser)
-	if err != nil {
-		return nil, err
-	}
-	if output == "" {
-		return nil, os.ErrNotExist
+	if ref := fs.hostPath(fileName); ref != nil {
+		defer ref.Close()
+		return fs.hostFileInfo(fileName, ref)
 	}
-	lines := strings.Split(output, "\n")
-	for i := 0; i < len(lines); i++ {
-		return createNewDockerFile(lines[i], fs.containerID)
+	if a := fs.agent(); a != nil {
+		resp, err := a.call(&agent.Request{Op: agent.OpLstat, Path: fileName})
+		if err != errAgentUnavailable {
+			if err != nil {
+				return nil, err
+			}
+			return newAgentFile(filepath.Dir(fileName), resp.Info, fs.containerID), nil
+		}
 	}
-	return nil, os.ErrNotExist
+	return fs.execStat(fileName, false)
 }
 
-func (file *dockerFile) execFileChmod(perm string) error {
-	return simpleExec(file.containerID, fmt.Sprintf("chmod %s '%s'",string(perm), file.name), file.root.config.DockerUser)
+// execRemove removes a file or symlink. Folders are refused.
+func (file *dockerFile) execRemove() error {
+	if ref := file.root.hostPath(file.name); ref != nil {
+		defer ref.Close()
+		if ref.m.readOnly {
+			return os.ErrPermission
+		}
+		return ref.do(func(path string) error {
+			if err := syscall.Unlink(path); err != nil {
+				return &os.PathError{Op: "remove", Err: err}
+			}
+			return nil
+		})
+	}
+	if a := file.root.agent(); a != nil {
+		_, err := a.call(&agent.Request{Op: agent.OpUnlink, Path: file.name})
+		if err != errAgentUnavailable {
+			return err
+		}
+	}
+	return simpleExec(file.containerID, []string{"rm", "--", file.name}, file.root.config.DockerUser)
 }
 
-func (file *dockerFile) execRemove() error {
-	flag := " "
-	if file.IsDir() {
-		flag = " -r "
+// execRmdir removes an empty folder.
+func (file *dockerFile) execRmdir() error {
+	if ref := file.root.hostPath(file.name); ref != nil {
+		defer ref.Close()
+		if ref.m.readOnly {
+			return os.ErrPermission
+		}
+		return ref.do(func(path string) error {
+			if err := syscall.Rmdir(path); err != nil {
+				return &os.PathError{Op: "rmdir", Err: err}
+			}
+			return nil
+		})
+	}
+	if a := file.root.agent(); a != nil {
+		_, err := a.call(&agent.Request{Op: agent.OpRmdir, Path: file.name})
+		if err != errAgentUnavailable {
+			return err
+		}
 	}
-	return simpleExec(file.containerID, fmt.Sprintf("rm -f %s '%s'", flag, file.name), file.root.config.DockerUser)
+	return simpleExec(file.containerID, []string{"rmdir", "--", file.name}, file.root.config.DockerUser)
 }
 
 func (file *dockerFile) execFileRename(targetName string) error {
-	return simpleExec(file.containerID, fmt.Sprintf("mv '%s' '%s'",file.name,targetName), file.root.config.DockerUser)
+	if ref := file.root.hostPath(file.name); ref != nil {
+		defer ref.Close()
+		if target := file.root.hostPath(targetName); target != nil {
+			defer target.Close()
+			if target.m == ref.m {
+				if ref.m.readOnly {
+					return os.ErrPermission
+				}
+				return ref.Rename(target)
+			}
+		}
+	}
+	if a := file.root.agent(); a != nil {
+		_, err := a.call(&agent.Request{Op: agent.OpRename, Path: file.name, Target: targetName})
+		if err != errAgentUnavailable {
+			return err
+		}
+	}
+	// -T replaces the target instead of moving into it if it is a folder.
+	return simpleExec(file.containerID, []string{"mv", "-T", "--", file.name, targetName}, file.root.config.DockerUser)
 }
 
 func (file *dockerFile) execTruncate(size uint64) error {
-	return simpleExec(file.containerID, fmt.Sprintf("truncate -s %s	'%s'" , strconv.FormatUint(size, 10), file.name), file.root.config.DockerUser)
+	if ref := file.root.hostFile(file.name); ref != nil {
+		defer ref.Close()
+		if ref.m.readOnly {
+			return os.ErrPermission
+		}
+		return ref.object(func(path string) error {
+			return os.Truncate(path, int64(size))
+		})
+	}
+	if a := file.root.agent(); a != nil {
+		_, err := a.call(&agent.Request{Op: agent.OpTruncate, Path: file.name, Length: int64(size)})
+		if err != errAgentUnavailable {
+			return err
+		}
+	}
+	return simpleExec(file.containerID, []string{"truncate", "-s", strconv.FormatUint(size, 10), "--", file.name}, file.root.config.DockerUser)
 }
 
-func (folder *dockerFile) execMkDir(folderName string) error {
-	return simpleExec(folder.containerID, fmt.Sprintf("mkdir -p '%s/%s'", folder.name, folderName), folder.root.config.DockerUser)
-}
\ No newline at end of file
+// execMkDir creates the folder path. Missing parents are created if parents
+// is set, otherwise it fails like mkdir(2) if the parent is missing or the folder exists.
+func (fs *root) execMkDir(path string, parents bool) error {
+	if ref := fs.hostLookup(path, false, parents); ref != nil {
+		defer ref.Close()
+		return fs.hostMkDir(ref, parents)
+	}
+	if a := fs.agent(); a != nil {
+		op := agent.OpMkdirSingle
+		if parents {
+			op = agent.OpMkdir
+		}
+		_, err := a.call(&agent.Request{Op: op, Path: path, Mode: uint32(fs.newDirMode())})
+		if err != errAgentUnavailable {
+			return err
+		}
+	}
+	cmd := []string{"mkdir", "-m", strconv.FormatUint(uint64(fs.newDirMode()), 8)}
+	if parents {
+		cmd = append(cmd, "-p")
+	}
+	return simpleExec(fs.containerID, append(cmd, "--", path), fs.config.DockerUser)
+}
@@ -3,6 +3,8 @@ package client
 import (
 	"github.com/andock/ssh2docksal"
 	"github.com/mholt/archiver"
+	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -165,15 +167,25 @@ func TestExecFileDownload(t *testing.T) {
 
 
 
+	root := getRoot(containerID, ssh2docksal.Config{DockerUser: "docker"})
+
 	for _, test := range tests {
 		targetFile := newDockerFile(test.dockerFile, false, containerID)
+		targetFile.root = root
 
-		error := targetFile.execFileDownload()
-		if targetFile.content == nil {
+		reader := targetFile.execFileReader()
+		content, err := ioutil.ReadAll(io.NewSectionReader(reader, 0, 1<<20))
+		reader.Close()
+		if err != nil || string(content) != "Test1" {
 			t.Errorf("Unable to download file %s to %s failed", test.dockerFile, test.localFile)
 		}
-		if error != nil {
-			t.Errorf("Unable to download file %s to %s failed", test.dockerFile, test.localFile)
+		// Resume at an offset.
+		part := make([]byte, 3)
+		reader = targetFile.execFileReader()
+		n, err := reader.ReadAt(part, 2)
+		reader.Close()
+		if n != 3 || string(part) != "st1" {
+			t.Errorf("Ranged read of %s returned %q %v", test.dockerFile, part[:n], err)
 		}
 	}
 }
@@ -207,4 +219,16 @@ func TestExecRename(t *testing.T) {
 			t.Errorf("Rename file %s to %s failed. File does not exists", test.sourceFile, test.targetFile)
 		}
 	}
+
+	os.Mkdir(testDir+"/rename_folder", 0777)
+	file, err := root.fetch(testDir + "/test1_rename.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.execFileRename(testDir + "/rename_folder"); err == nil {
+		t.Errorf("Rename of a file to a folder should fail")
+	}
+	if _, err := os.Stat(testDir + "/rename_folder/test1_rename.txt"); err == nil {
+		t.Errorf("Rename should not move the file into the folder")
+	}
 }
@@ -0,0 +1,850 @@
+package client
+
+// OpenSSH protocol extensions which the sftp request server doesn't support.
+// The channel of the sftp subsystem is wrapped: extension requests are answered
+// here and never reach the request server. posix-rename and hardlink are
+// handled by the request server itself. Requests which may block are answered
+// by their own goroutine, so they don't hold up the other requests.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/andock/ssh2docksal/agent"
+	"github.com/pkg/sftp"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Packet types and status codes of the sftp protocol.
+const (
+	fxpVersion       = 2
+	fxpOpen          = 3
+	fxpClose         = 4
+	fxpWrite         = 6
+	fxpRename        = 18
+	fxpOpendir       = 11
+	fxpStatus        = 101
+	fxpHandle        = 102
+	fxpName          = 104
+	fxpExtended      = 200
+	fxpExtendedReply = 201
+
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+
+	fxOK               = 0
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+const (
+	// maxPacketLength is the longest packet accepted by the request server.
+	maxPacketLength = 256 * 1024
+	// maxReadLength is the longest read answered by the request server.
+	maxReadLength = 1 << 15
+)
+
+// sftpExtensions are advertised instead of the extensions of the request server,
+// which advertises different ones depending on its version.
+var sftpExtensions = []struct{ name, data string }{
+	// Handled by the request server.
+	{"posix-rename@openssh.com", "1"},
+	{"hardlink@openssh.com", "1"},
+	{"statvfs@openssh.com", "2"},
+	{"fstatvfs@openssh.com", "2"},
+	{"fsync@openssh.com", "1"},
+	{"limits@openssh.com", "1"},
+	{"expand-path@openssh.com", "1"},
+	{"copy-data", "1"},
+}
+
+var errInvalidHandle = errors.New("Invalid handle")
+
+// extensionChannel answers the extension requests of a sftp session.
+type extensionChannel struct {
+	channel io.ReadWriteCloser
+	fs      *root
+	// in holds the rest of a request for the request server.
+	in []byte
+	// out collects the responses of the request server until a packet is complete.
+	out       []byte
+	writeLock sync.Mutex
+	// opens maps the ids of open requests to their path until the handle is sent.
+	opens   map[uint32]string
+	handles map[string]string
+	// writeOpens and uploads hold the open requests and handles for writing,
+	// readOpens and reads the ones for reading.
+	writeOpens map[uint32]bool
+	uploads    map[string]bool
+	readOpens  map[uint32]bool
+	reads      map[string]bool
+	// written counts the bytes sent per upload handle, closedBytes per close request.
+	written     map[string]int64
+	closedBytes map[uint32]int64
+	// closes maps the ids of close requests of uploads to their path.
+	closes map[uint32]string
+	// renames maps the ids of rename requests to their target.
+	renames     map[uint32]string
+	handlesLock sync.Mutex
+	// policy restricts the session, nil if it is not restricted. Recorded
+	// handle paths are container paths.
+	policy *policyFS
+}
+
+// SftpChannel implements ssh2docksal.SftpExtensionHandler.
+func (fs *root) SftpChannel(channel io.ReadWriteCloser) io.ReadWriteCloser {
+	if fs.config.SftpUploadBatch > 0 {
+		fs.batch = newUploadBatch(fs, fs.config.SftpUploadBatch)
+	}
+	if hooks := fs.config.GetUploadHooks(); len(hooks) > 0 {
+		fs.hooks = newUploadHooks(fs, hooks)
+	}
+	return &extensionChannel{
+		channel:     channel,
+		fs:          fs,
+		opens:       make(map[uint32]string),
+		handles:     make(map[string]string),
+		writeOpens:  make(map[uint32]bool),
+		uploads:     make(map[string]bool),
+		readOpens:   make(map[uint32]bool),
+		reads:       make(map[string]bool),
+		written:     make(map[string]int64),
+		closedBytes: make(map[uint32]int64),
+		closes:      make(map[uint32]string),
+		renames:     make(map[uint32]string),
+	}
+}
+
+// Read passes the requests which are not answered here to the request server.
+func (c *extensionChannel) Read(p []byte) (int, error) {
+	for len(c.in) == 0 {
+		packet, err := readPacket(c.channel)
+		if err != nil {
+			c.interrupted()
+			return 0, err
+		}
+		if !c.intercept(packet[4:]) {
+			c.in = packet
+		}
+	}
+	n := copy(p, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// Write sends the responses of the request server. The version lists the
+// extensions, handles are recorded for the extensions using them. Close
+// responses of uploads and rename responses are sent by their own goroutine
+// once the upload is committed and the upload hooks ran.
+func (c *extensionChannel) Write(p []byte) (int, error) {
+	c.out = append(c.out, p...)
+	for len(c.out) >= 4 {
+		length := int(binary.BigEndian.Uint32(c.out))
+		if len(c.out) < 4+length {
+			break
+		}
+		body := c.out[4 : 4+length : 4+length]
+		c.out = c.out[4+length:]
+		if length > 0 {
+			switch body[0] {
+			case fxpVersion:
+				body = appendExtensions(body)
+			case fxpHandle:
+				c.responded(body[0], &packetData{b: body[1:]})
+			case fxpStatus:
+				c.responded(body[0], &packetData{b: body[1:]})
+				if c.closing(body) {
+					go func(body []byte) {
+						if err := c.send(c.closed(body)); err != nil {
+							c.channel.Close()
+						}
+					}(body)
+					continue
+				}
+			}
+		}
+		if err := c.send(body); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.out) == 0 {
+		c.out = nil
+	}
+	return len(p), nil
+}
+
+func (c *extensionChannel) Close() error {
+	return c.channel.Close()
+}
+
+// send writes a packet prefixed with its length.
+func (c *extensionChannel) send(body []byte) error {
+	packet := appendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	packet = append(packet, body...)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.channel.Write(packet)
+	return err
+}
+
+// intercept answers extension requests. Returns false if the request is for the request server.
+func (c *extensionChannel) intercept(body []byte) bool {
+	data := &packetData{b: body[1:]}
+	switch body[0] {
+	case fxpOpen, fxpOpendir:
+		id, name := data.uint32(), data.string()
+		var flags uint32
+		if body[0] == fxpOpen {
+			flags = data.uint32()
+		}
+		if data.err == nil {
+			c.handlesLock.Lock()
+			c.opens[id] = c.containerPath(cleanSftpPath(name))
+			if flags&(fxfWrite|fxfAppend|fxfCreat|fxfTrunc) != 0 {
+				c.writeOpens[id] = true
+			}
+			if flags&fxfRead != 0 {
+				c.readOpens[id] = true
+			}
+			c.handlesLock.Unlock()
+		}
+	case fxpWrite:
+		data.uint32()
+		handle := data.string()
+		data.uint64()
+		length := data.uint32()
+		c.handlesLock.Lock()
+		if c.uploads[handle] && data.err == nil {
+			c.written[handle] += int64(length)
+		}
+		c.handlesLock.Unlock()
+	case fxpClose:
+		id, handle := data.uint32(), data.string()
+		c.handlesLock.Lock()
+		if c.uploads[handle] {
+			c.closes[id] = c.handles[handle]
+			c.closedBytes[id] = c.written[handle]
+		}
+		delete(c.handles, handle)
+		delete(c.uploads, handle)
+		delete(c.reads, handle)
+		delete(c.written, handle)
+		c.handlesLock.Unlock()
+	case fxpRename:
+		c.renaming(data.uint32(), data)
+	case fxpExtended:
+		id, name := data.uint32(), data.string()
+		if data.err != nil {
+			return false
+		}
+		if name == "posix-rename@openssh.com" {
+			c.renaming(id, data)
+			return false
+		}
+		answer, ok := c.extension(id, name, data)
+		if !ok {
+			return false
+		}
+		go func() {
+			if err := c.send(answer()); err != nil {
+				c.channel.Close()
+			}
+		}()
+		return true
+	}
+	return false
+}
+
+// responded records the handle of an open request.
+func (c *extensionChannel) responded(packetType byte, data *packetData) {
+	id := data.uint32()
+	c.handlesLock.Lock()
+	defer c.handlesLock.Unlock()
+	if name, ok := c.opens[id]; ok && packetType == fxpHandle {
+		if handle := data.string(); data.err == nil {
+			c.handles[handle] = name
+			if c.writeOpens[id] {
+				c.uploads[handle] = true
+			}
+			if c.readOpens[id] {
+				c.reads[handle] = true
+			}
+		}
+	}
+	delete(c.opens, id)
+	delete(c.writeOpens, id)
+	delete(c.readOpens, id)
+}
+
+// renaming records the target of a rename request for the upload hooks.
+func (c *extensionChannel) renaming(id uint32, data *packetData) {
+	data.string()
+	target := data.string()
+	if data.err != nil || c.fs.hooks == nil {
+		return
+	}
+	c.handlesLock.Lock()
+	defer c.handlesLock.Unlock()
+	c.renames[id] = c.containerPath(cleanSftpPath(target))
+}
+
+// closing checks if the status response answers the close of an upload or a rename.
+func (c *extensionChannel) closing(body []byte) bool {
+	id := (&packetData{b: body[1:]}).uint32()
+	c.handlesLock.Lock()
+	defer c.handlesLock.Unlock()
+	_, upload := c.closes[id]
+	_, renamed := c.renames[id]
+	return upload || renamed
+}
+
+// closed returns the close response of an upload once the upload is committed
+// and the upload hooks ran. Successful responses become an error status if the
+// commit or a reporting hook failed. Renames run the hooks of their target.
+// Uploads are audited with their final result.
+func (c *extensionChannel) closed(body []byte) []byte {
+	data := &packetData{b: body[1:]}
+	id, code := data.uint32(), data.uint32()
+	message := data.string()
+	c.handlesLock.Lock()
+	name, upload := c.closes[id]
+	delete(c.closes, id)
+	written := c.closedBytes[id]
+	delete(c.closedBytes, id)
+	target, renamed := c.renames[id]
+	delete(c.renames, id)
+	c.handlesLock.Unlock()
+	var err error
+	if code != fxOK || data.err != nil {
+		err = errors.New(message)
+	}
+	if upload && c.fs.batch != nil {
+		if _, commitErr := c.fs.batch.wait(name); err == nil {
+			err = commitErr
+		}
+	}
+	if err == nil && c.fs.hooks != nil && (upload || renamed) {
+		hookName := name
+		if renamed {
+			hookName = target
+		}
+		err = c.fs.hooks.completed(hookName)
+	}
+	if upload {
+		c.fs.config.Audit("write", name, "", written, err)
+	}
+	if err != nil && code == fxOK && data.err == nil {
+		return statusPacket(id, err)
+	}
+	return body
+}
+
+// interrupted audits the uploads which were not closed when the connection dropped.
+func (c *extensionChannel) interrupted() {
+	c.handlesLock.Lock()
+	defer c.handlesLock.Unlock()
+	for handle := range c.uploads {
+		c.fs.config.Audit("write", c.handles[handle], "", c.written[handle], errors.New("Connection lost"))
+		delete(c.uploads, handle)
+	}
+}
+
+// containerPath maps a path of the client to the container.
+func (c *extensionChannel) containerPath(name string) string {
+	if c.policy == nil {
+		return name
+	}
+	return c.policy.containerPath(name)
+}
+
+// allowed checks the access of a container path against the policy of the session.
+func (c *extensionChannel) allowed(name string, write bool) error {
+	if c.policy == nil {
+		return nil
+	}
+	return c.policy.check(name, write, true)
+}
+
+// handlePath returns the path of a handle of the request server. The handle
+// has to be opened for reading if read is set and for writing if write is set.
+func (c *extensionChannel) handlePath(handle string, read bool, write bool) (string, error) {
+	c.handlesLock.Lock()
+	defer c.handlesLock.Unlock()
+	name, ok := c.handles[handle]
+	if !ok || read && !c.reads[handle] || write && !c.uploads[handle] {
+		return "", errInvalidHandle
+	}
+	return name, nil
+}
+
+// extension parses the request of the extension name and returns the function
+// answering it, which may block. Returns false for unknown extensions.
+func (c *extensionChannel) extension(id uint32, name string, data *packetData) (func() []byte, bool) {
+	invalid := func() []byte {
+		response := appendUint32([]byte{fxpStatus}, id)
+		response = appendUint32(response, fxBadMessage)
+		response = appendString(response, "Invalid "+name+" request")
+		return appendString(response, "")
+	}
+	switch name {
+	case "statvfs@openssh.com":
+		fileName := data.string()
+		if data.err != nil {
+			return invalid, true
+		}
+		fileName = c.containerPath(cleanSftpPath(fileName))
+		return func() []byte {
+			err := c.allowed(fileName, false)
+			var info *agent.FSInfo
+			if err == nil {
+				info, err = c.fs.execStatFS(fileName)
+			}
+			return statFSPacket(id, info, err)
+		}, true
+	case "fstatvfs@openssh.com":
+		handle := data.string()
+		if data.err != nil {
+			return invalid, true
+		}
+		fileName, err := c.handlePath(handle, false, false)
+		return func() []byte {
+			if err == nil {
+				err = c.allowed(fileName, false)
+			}
+			var info *agent.FSInfo
+			if err == nil {
+				info, err = c.fs.execStatFS(fileName)
+			}
+			return statFSPacket(id, info, err)
+		}, true
+	case "fsync@openssh.com":
+		handle := data.string()
+		if data.err != nil {
+			return invalid, true
+		}
+		fileName, err := c.handlePath(handle, false, false)
+		return func() []byte {
+			if err == nil {
+				err = c.fs.execFsync(fileName)
+			}
+			return statusPacket(id, err)
+		}, true
+	case "limits@openssh.com":
+		return func() []byte {
+			response := appendUint32([]byte{fxpExtendedReply}, id)
+			response = appendUint64(response, maxPacketLength)
+			response = appendUint64(response, maxReadLength)
+			// Room for the header of the write request.
+			response = appendUint64(response, maxPacketLength-1024)
+			// Open handles are not limited.
+			return appendUint64(response, 0)
+		}, true
+	case "expand-path@openssh.com":
+		fileName := data.string()
+		if data.err != nil {
+			return invalid, true
+		}
+		return func() []byte {
+			expanded, err := c.fs.expandPath(fileName)
+			if err != nil {
+				return statusPacket(id, err)
+			}
+			if c.policy != nil && strings.HasPrefix(fileName, "~") {
+				expanded = c.policy.jailedPath(expanded)
+			}
+			response := appendUint32([]byte{fxpName}, id)
+			response = appendUint32(response, 1)
+			response = appendString(response, expanded)
+			response = appendString(response, expanded)
+			// No attributes.
+			return appendUint32(response, 0)
+		}, true
+	case "copy-data":
+		readHandle, readOffset, length := data.string(), data.uint64(), data.uint64()
+		writeHandle, writeOffset := data.string(), data.uint64()
+		if data.err != nil || readOffset > math.MaxInt64 || length > math.MaxInt64 || writeOffset > math.MaxInt64 {
+			return invalid, true
+		}
+		src, err := c.handlePath(readHandle, true, false)
+		var dst string
+		if err == nil {
+			dst, err = c.handlePath(writeHandle, false, true)
+		}
+		return func() []byte {
+			if err == nil {
+				err = c.allowed(src, false)
+			}
+			if err == nil {
+				err = c.allowed(dst, true)
+			}
+			if err == nil {
+				err = c.fs.copyData(src, int64(readOffset), int64(length), dst, int64(writeOffset))
+			}
+			return statusPacket(id, err)
+		}, true
+	}
+	return nil, false
+}
+
+// statusPacket returns the status response of err.
+func statusPacket(id uint32, err error) []byte {
+	code, message := uint32(fxOK), ""
+	if err != nil {
+		code, message = fxFailure, err.Error()
+		switch sftpError(err) {
+		case sftp.ErrSSHFxNoSuchFile:
+			code = fxNoSuchFile
+		case sftp.ErrSSHFxPermissionDenied:
+			code = fxPermissionDenied
+		case sftp.ErrSSHFxOpUnsupported:
+			code = fxOpUnsupported
+		}
+	}
+	response := appendUint32([]byte{fxpStatus}, id)
+	response = appendUint32(response, code)
+	response = appendString(response, message)
+	return appendString(response, "")
+}
+
+// statFSPacket returns the statvfs response of info.
+func statFSPacket(id uint32, info *agent.FSInfo, err error) []byte {
+	if err != nil {
+		return statusPacket(id, err)
+	}
+	response := appendUint32([]byte{fxpExtendedReply}, id)
+	for _, value := range []uint64{
+		info.BlockSize, info.FragmentSize, info.Blocks, info.BlocksFree, info.BlocksAvail,
+		info.Files, info.FilesFree, info.FilesAvail, info.ID, info.Flags, info.NameMax,
+	} {
+		response = appendUint64(response, value)
+	}
+	return response
+}
+
+// appendExtensions replaces the extensions of a version packet with sftpExtensions.
+func appendExtensions(body []byte) []byte {
+	// Type and version.
+	body = body[:5:5]
+	for _, extension := range sftpExtensions {
+		body = appendString(body, extension.name)
+		body = appendString(body, extension.data)
+	}
+	return body
+}
+
+// readPacket reads a packet including its length.
+func readPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > maxPacketLength {
+		return nil, fmt.Errorf("Invalid sftp packet length %d", length)
+	}
+	packet := make([]byte, 4+length)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[4:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// packetData reads the fields of a packet. The first error is kept.
+type packetData struct {
+	b   []byte
+	err error
+}
+
+func (d *packetData) uint32() uint32 {
+	if d.err != nil || len(d.b) < 4 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	value := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return value
+}
+
+func (d *packetData) uint64() uint64 {
+	if d.err != nil || len(d.b) < 8 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	value := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return value
+}
+
+func (d *packetData) string() string {
+	length := d.uint32()
+	if d.err != nil || uint32(len(d.b)) < length {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	value := string(d.b[:length])
+	d.b = d.b[length:]
+	return value
+}
+
+func appendUint32(b []byte, value uint32) []byte {
+	return append(b, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func appendUint64(b []byte, value uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(value>>32)), uint32(value))
+}
+
+func appendString(b []byte, value string) []byte {
+	return append(appendUint32(b, uint32(len(value))), value...)
+}
+
+// cleanSftpPath makes a path of a request absolute like the request server does.
+func cleanSftpPath(name string) string {
+	name = filepath.ToSlash(name)
+	if !path.IsAbs(name) {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
+
+// execStatFS returns the file system info of a path.
+func (fs *root) execStatFS(fileName string) (*agent.FSInfo, error) {
+	defer fs.execSlot()()
+	if ref := fs.hostFile(fileName); ref != nil {
+		defer ref.Close()
+		var info *agent.FSInfo
+		err := ref.object(func(path string) (err error) {
+			info, err = agent.StatFS(path)
+			return err
+		})
+		if err == nil && ref.m.readOnly {
+			info.Flags |= agent.FSReadOnly
+		}
+		return info, err
+	}
+	if a := fs.agent(); a != nil {
+		resp, err := a.call(&agent.Request{Op: agent.OpStatFS, Path: fileName})
+		if err != errAgentUnavailable {
+			if err != nil {
+				return nil, err
+			}
+			return resp.FS, nil
+		}
+	}
+	output, err := outpuExec(fs.containerID, []string{"stat", "-f", "-c", "%s %S %b %f %a %c %d %i %l", "--", fileName}, fs.config.DockerUser)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatFS(output)
+}
+
+// parseStatFS parses the output of stat -f -c '%s %S %b %f %a %c %d %i %l'.
+func parseStatFS(output string) (*agent.FSInfo, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 9 {
+		return nil, fmt.Errorf("Invalid stat output: %q", output)
+	}
+	values := make([]uint64, len(fields))
+	for i, field := range fields {
+		base := 10
+		if i == 7 {
+			// The file system id is hex.
+			base = 16
+		}
+		value, err := strconv.ParseUint(field, base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid stat output: %q", output)
+		}
+		values[i] = value
+	}
+	return &agent.FSInfo{
+		BlockSize:    values[0],
+		FragmentSize: values[1],
+		Blocks:       values[2],
+		BlocksFree:   values[3],
+		BlocksAvail:  values[4],
+		Files:        values[5],
+		FilesFree:    values[6],
+		FilesAvail:   values[6],
+		ID:           values[7],
+		NameMax:      values[8],
+	}, nil
+}
+
+// execFsync flushes the open upload of a file. Writes through the agent and
+// execs are not buffered by ssh2docksal.
+func (fs *root) execFsync(fileName string) error {
+	fs.filesLock.Lock()
+	var upload pendingUpload
+	if file, ok := fs.files[fileName]; ok {
+		upload = file.upload
+	}
+	fs.filesLock.Unlock()
+	if syncer, ok := upload.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	if ref := fs.hostFile(fileName); ref != nil {
+		defer ref.Close()
+		file, err := ref.Open(os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return file.Sync()
+	}
+	return nil
+}
+
+// expandPath expands ~ and ~user to the home folder in the container.
+func (fs *root) expandPath(name string) (string, error) {
+	if !strings.HasPrefix(name, "~") {
+		return cleanSftpPath(name), nil
+	}
+	user, rest := name[1:], ""
+	if i := strings.Index(user, "/"); i >= 0 {
+		user, rest = user[:i], user[i+1:]
+	}
+	if user == "" {
+		user = strings.SplitN(fs.config.DockerUser, ":", 2)[0]
+	}
+	defer fs.execSlot()()
+	passwd, err := outputExecCmd(fs.containerID, []string{"cat", "/etc/passwd"}, fs.config.DockerUser)
+	if err != nil {
+		return "", err
+	}
+	home, err := passwdHome(passwd, user)
+	if err != nil {
+		return "", err
+	}
+	return cleanSftpPath(path.Join(home, rest)), nil
+}
+
+// passwdHome returns the home folder of user, a name or uid, from the content of /etc/passwd.
+func passwdHome(passwd string, user string) (string, error) {
+	for _, line := range strings.Split(passwd, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 6 && (fields[0] == user || fields[2] == user) {
+			return fields[5], nil
+		}
+	}
+	return "", &os.PathError{Op: "expand-path", Path: "~" + user, Err: syscall.ENOENT}
+}
+
+// copyData copies length bytes (0 for all) from src at off to dst at dstOff
+// inside of the container.
+func (fs *root) copyData(src string, off int64, length int64, dst string, dstOff int64) error {
+	if src == dst && (length == 0 || off < dstOff+length && dstOff < off+length) {
+		return fmt.Errorf("Overlapping copy of %s", src)
+	}
+	if length == 0 {
+		length = math.MaxInt64 - off
+	}
+	reader, writer, done, err := fs.openCopy(src, dst)
+	if err != nil {
+		fs.config.Audit("copy", dst, src, 0, err)
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	n, err := io.Copy(&offsetWriter{writer: writer, off: dstOff}, io.NewSectionReader(reader, off, length))
+	if doneErr := done(); err == nil {
+		err = doneErr
+	}
+	fs.changed(dst)
+	fs.config.Audit("copy", dst, src, n, err)
+	return err
+}
+
+// openCopy opens the files of copyData.
+func (fs *root) openCopy(src string, dst string) (io.ReaderAt, io.WriterAt, func() error, error) {
+	defer fs.lockPaths(src, dst)()
+	defer fs.execSlot()()
+	srcFile, err := fs.fetch(src)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dstFile, err := fs.fetch(dst)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reader, err := fs.openReader(srcFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	writer, done, err := fs.openWriter(dstFile)
+	if err != nil {
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, nil, nil, err
+	}
+	return reader, writer, done, nil
+}
+
+// openWriter returns a writer of the file content. Open uploads are written to
+// directly, done finishes the write.
+func (fs *root) openWriter(file *dockerFile) (io.WriterAt, func() error, error) {
+	if file.isdir {
+		return nil, nil, os.ErrInvalid
+	}
+	forget := func() error {
+		fs.forget(file.name)
+		return nil
+	}
+	if w, ok := fs.upload(file).(io.WriterAt); ok {
+		return w, func() error { return nil }, nil
+	}
+	if ref := fs.hostFile(file.name); ref != nil {
+		defer ref.Close()
+		if ref.m.readOnly {
+			return nil, nil, os.ErrPermission
+		}
+		hostFile, err := ref.Open(os.O_WRONLY, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &limitedFile{File: hostFile, file: file}, func() error {
+			defer forget()
+			return hostFile.Close()
+		}, nil
+	}
+	if a := fs.agent(); a != nil {
+		return &agentWriter{file: file, agent: a, path: file.name, mode: fs.uploadMode(file, true)}, forget, nil
+	}
+	w, err := fs.newSpoolWriter(file, sftp.FileOpenFlags{}, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, func() error {
+		defer forget()
+		return w.Close()
+	}, nil
+}
+
+// offsetWriter writes sequentially to a WriterAt.
+type offsetWriter struct {
+	writer io.WriterAt
+	off    int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
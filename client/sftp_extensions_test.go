@@ -0,0 +1,203 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/andock/ssh2docksal"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtensionChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+	fs.dockerFile = newDockerFile("/", true, "")
+	fs.dockerFile.root = fs
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("abcdef"), 0644)
+
+	c1, c2 := netPipe(t)
+	server := sftp.NewRequestServer(fs.SftpChannel(c1), sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+	go server.Serve()
+	defer server.Close()
+	client, err := sftp.NewClientPipe(c2, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stat, err := client.StatVFS("/var/www")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks == 0 || stat.Namemax == 0 {
+		t.Errorf("StatVFS: got %+v", stat)
+	}
+	if err := client.Link("/var/www/a.txt", "/var/www/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.Stat(filepath.Join(dir, "a.txt"))
+	c, _ := os.Stat(filepath.Join(dir, "c.txt"))
+	if !os.SameFile(a, c) {
+		t.Errorf("Link should create a hardlink")
+	}
+	// Other requests still reach the request server.
+	if files, err := client.ReadDir("/var/www"); err != nil || len(files) != 3 {
+		t.Errorf("ReadDir: got %d files, %v", len(files), err)
+	}
+
+	if err := fs.copyData("/var/www/a.txt", 2, 3, "/var/www/b.txt", 4); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "b.txt")); string(content) != "abcd234" {
+		t.Errorf("copyData: got %q", content)
+	}
+	if err := fs.copyData("/var/www/b.txt", 0, 0, "/var/www/b.txt", 2); err == nil {
+		t.Errorf("copyData should refuse overlapping ranges")
+	}
+}
+
+func TestParseStatFS(t *testing.T) {
+	info, err := parseStatFS("4096 4096 1000 500 400 200 100 a1b2 255\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BlockSize != 4096 || info.Blocks != 1000 || info.BlocksAvail != 400 || info.FilesAvail != 100 || info.ID != 0xa1b2 || info.NameMax != 255 {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	if _, err := parseStatFS("4096 4096"); err == nil {
+		t.Errorf("Expected an error for incomplete output")
+	}
+}
+
+func TestPasswdHome(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/bash\ndocker:x:1000:1000::/home/docker:/bin/bash\n"
+	tests := map[string]string{"root": "/root", "docker": "/home/docker", "1000": "/home/docker"}
+	for user, expected := range tests {
+		if home, err := passwdHome(passwd, user); err != nil || home != expected {
+			t.Errorf("passwdHome(%q): got %q %v", user, home, err)
+		}
+	}
+	if _, err := passwdHome(passwd, "nobody"); !os.IsNotExist(err) {
+		t.Errorf("Expected os.ErrNotExist for unknown users, got %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	auditFile := filepath.Join(dir, "audit.log")
+	auditLog, err := ssh2docksal.OpenAuditLog(auditFile, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "www"), 0755)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: filepath.Join(dir, "www")}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+		config: ssh2docksal.Config{Project: "shop", Service: "cli", AuditLog: auditLog},
+	}
+	fs.dockerFile = newDockerFile("/", true, "")
+	fs.dockerFile.root = fs
+	c1, c2 := netPipe(t)
+	server := sftp.NewRequestServer(fs.SftpChannel(c1), sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+	go server.Serve()
+	defer server.Close()
+	client, err := sftp.NewClientPipe(c2, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	file, err := client.Create("/var/www/index.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("<?php echo 1;"))
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	client.Rename("/var/www/index.php", "/var/www/home.php")
+	client.Remove("/var/www/index.php")
+
+	content, _ := ioutil.ReadFile(auditFile)
+	var entries []ssh2docksal.AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry ssh2docksal.AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %s", content)
+	}
+	if e := entries[0]; e.Op != "write" || e.Path != "/var/www/index.php" || e.Bytes != 13 || e.Result != "ok" || e.Project != "shop" {
+		t.Errorf("Unexpected upload entry %+v", e)
+	}
+	if e := entries[1]; e.Op != "rename" || e.Path != "/var/www/index.php" || e.Target != "/var/www/home.php" || e.Result != "ok" {
+		t.Errorf("Unexpected rename entry %+v", e)
+	}
+	if e := entries[2]; e.Op != "remove" || e.Result != "failed" || e.Error == "" {
+		t.Errorf("Expected the failed removal, got %+v", e)
+	}
+}
+
+func TestExtensionHandles(t *testing.T) {
+	c := (&root{}).SftpChannel(nil).(*extensionChannel)
+	open := func(id uint32, handle string, flags uint32) {
+		body := appendUint32([]byte{fxpOpen}, id)
+		body = appendString(body, "/var/www/"+handle)
+		c.intercept(appendUint32(body, flags))
+		c.responded(fxpHandle, &packetData{b: appendString(appendUint32(nil, id), handle)})
+	}
+	open(1, "read", fxfRead)
+	open(2, "write", fxfWrite|fxfCreat)
+	open(3, "both", fxfRead|fxfWrite)
+
+	for _, test := range []struct {
+		handle      string
+		read, write bool
+		valid       bool
+	}{
+		{handle: "read", read: true, valid: true},
+		{handle: "read", write: true, valid: false},
+		{handle: "write", write: true, valid: true},
+		{handle: "write", read: true, valid: false},
+		{handle: "both", read: true, write: true, valid: true},
+		{handle: "missing", valid: false},
+	} {
+		if _, err := c.handlePath(test.handle, test.read, test.write); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for handle %s read %t write %t: %v", test.handle, test.read, test.write, err)
+		}
+	}
+
+	// The extensions of the request server are replaced.
+	version := appendUint32([]byte{fxpVersion}, 3)
+	version = appendString(appendString(version, "hardlink@openssh.com"), "1")
+	data := &packetData{b: appendExtensions(version)[1:]}
+	data.uint32()
+	var names []string
+	for len(data.b) > 0 {
+		names = append(names, data.string())
+		data.string()
+	}
+	if data.err != nil || len(names) != len(sftpExtensions) || names[0] != "posix-rename@openssh.com" || names[1] != "hardlink@openssh.com" {
+		t.Errorf("Unexpected extensions %v", names)
+	}
+}
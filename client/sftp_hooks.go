@@ -0,0 +1,106 @@
+package client
+
+// Upload hooks run commands in the container after sftp uploads and renames
+// completed, e.g. drush cr after template changes. The files are collected
+// per hook until no further file matched for the debounce time and passed to
+// the command at once. Reporting hooks run before the client gets the status
+// of the upload, their failure becomes the error of the upload.
+
+import (
+	"fmt"
+	"github.com/andock/ssh2docksal"
+	"github.com/apex/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadHooks runs the upload hooks of a session.
+type uploadHooks struct {
+	fs    *root
+	hooks []ssh2docksal.UploadHook
+	lock  sync.Mutex
+	// pending holds the collected files per debounced hook.
+	pending map[int]*pendingHook
+	// run executes a hook with files.
+	run func(hook *ssh2docksal.UploadHook, files []string) error
+}
+
+type pendingHook struct {
+	files []string
+	seen  map[string]bool
+	timer *time.Timer
+}
+
+func newUploadHooks(fs *root, hooks []ssh2docksal.UploadHook) *uploadHooks {
+	h := &uploadHooks{fs: fs, hooks: hooks, pending: make(map[int]*pendingHook)}
+	h.run = h.exec
+	return h
+}
+
+// completed runs the hooks matching the container path name. Returns the
+// error of the first failed reporting hook.
+func (h *uploadHooks) completed(name string) error {
+	var err error
+	for i := range h.hooks {
+		hook := &h.hooks[i]
+		if !hook.Matches(name) {
+			continue
+		}
+		if !hook.Report {
+			h.debounce(i, name)
+		} else if hookErr := h.run(hook, []string{name}); err == nil {
+			err = hookErr
+		}
+	}
+	return err
+}
+
+// debounce adds name to the files of hook i and restarts its timer.
+func (h *uploadHooks) debounce(i int, name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	debounce := h.hooks[i].GetDebounce()
+	pending := h.pending[i]
+	if pending == nil {
+		pending = &pendingHook{seen: make(map[string]bool)}
+		pending.timer = time.AfterFunc(debounce, func() { h.flush(i, pending) })
+		h.pending[i] = pending
+	} else {
+		pending.timer.Reset(debounce)
+	}
+	if !pending.seen[name] {
+		pending.seen[name] = true
+		pending.files = append(pending.files, name)
+	}
+}
+
+// flush runs hook i with the collected files.
+func (h *uploadHooks) flush(i int, pending *pendingHook) {
+	h.lock.Lock()
+	if h.pending[i] != pending {
+		// Flushed already, the timer was restarted after it fired.
+		h.lock.Unlock()
+		return
+	}
+	delete(h.pending, i)
+	h.lock.Unlock()
+	h.run(&h.hooks[i], pending.files)
+}
+
+// exec runs the command of hook in the container with the files as arguments.
+func (h *uploadHooks) exec(hook *ssh2docksal.UploadHook, files []string) error {
+	defer h.fs.execSlot()()
+	cmd := append([]string{"sh", "-c", hook.Command, "sh"}, files...)
+	output, code, err := commandExecCmd(h.fs.containerID, cmd, h.fs.config.DockerUser)
+	output = strings.TrimSpace(output)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("Upload hook failed with exit code %d: %s", code, output)
+	}
+	if err != nil {
+		log.Warnf("SFTP: Upload hook %s for %s failed: %s", hook.Command, strings.Join(files, " "), err.Error())
+		return err
+	}
+	log.Infof("SFTP: Upload hook %s for %d files: %s", hook.Command, len(files), output)
+	return nil
+}
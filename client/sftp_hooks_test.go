@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"github.com/andock/ssh2docksal"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookCalls records the runs of upload hooks.
+type hookCalls struct {
+	lock  sync.Mutex
+	calls [][]string
+}
+
+func (c *hookCalls) run(hook *ssh2docksal.UploadHook, files []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls = append(c.calls, append([]string{hook.Command}, files...))
+	if hook.Report {
+		return errors.New("PHP Parse error: syntax error")
+	}
+	return nil
+}
+
+func (c *hookCalls) get() [][]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls
+}
+
+func TestUploadHooksDebounce(t *testing.T) {
+	calls := &hookCalls{}
+	h := newUploadHooks(&root{}, []ssh2docksal.UploadHook{
+		{Paths: []string{"*.twig"}, Command: "drush cr", Debounce: "100ms"},
+		{Paths: []string{"/var/www/docroot/*.php"}, Command: "php -l", Debounce: "100ms"},
+	})
+	h.run = calls.run
+	for _, name := range []string{"/var/www/a.twig", "/var/www/b.twig", "/var/www/a.twig", "/var/www/a.css", "/var/www/index.php"} {
+		if err := h.completed(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(calls.get()) != 0 {
+		t.Errorf("Expected the hooks to wait for more files")
+	}
+	time.Sleep(300 * time.Millisecond)
+	result := calls.get()
+	if len(result) != 1 || strings.Join(result[0], " ") != "drush cr /var/www/a.twig /var/www/b.twig" {
+		t.Errorf("Expected one run of the matching hook with all files, got %q", result)
+	}
+}
+
+func TestUploadHooksReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+		config: ssh2docksal.Config{UploadHooks: []ssh2docksal.UploadHook{
+			{Paths: []string{"*.php"}, Command: "php -l \"$1\"", Report: true},
+			{Paths: []string{"*.twig"}, Command: "drush cr", Debounce: "10ms"},
+		}},
+	}
+	fs.dockerFile = newDockerFile("/", true, "")
+	fs.dockerFile.root = fs
+	c1, c2 := netPipe(t)
+	server := sftp.NewRequestServer(fs.SftpChannel(c1), sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+	go server.Serve()
+	defer server.Close()
+	client, err := sftp.NewClientPipe(c2, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	calls := &hookCalls{}
+	fs.hooks.run = calls.run
+
+	file, err := client.Create("/var/www/index.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("<?php echo"))
+	if err := file.Close(); err == nil || !strings.Contains(err.Error(), "PHP Parse error") {
+		t.Errorf("Expected the output of the failed hook as error, got %v", err)
+	}
+	file, _ = client.Create("/var/www/page.html")
+	file.Write([]byte("<html>"))
+	if err := file.Close(); err != nil {
+		t.Errorf("Expected files without hooks to upload, got %v", err)
+	}
+	if err := client.Rename("/var/www/page.html", "/var/www/page.html.twig"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	result := calls.get()
+	if len(result) != 2 || result[0][1] != "/var/www/index.php" || strings.Join(result[1], " ") != "drush cr /var/www/page.html.twig" {
+		t.Errorf("Expected the hooks of the upload and the rename, got %q", result)
+	}
+}
@@ -0,0 +1,579 @@
+package client
+
+// Serves sftp paths below bind mounts of the container directly from the host file system.
+// The host folders have to be visible to ssh2docksal at the same path (or below Config.HostRoot).
+// Paths are looked up below the mount without following symlinks out of it
+// and the files are accessed with the permissions of the exec user.
+
+import (
+	"errors"
+	"github.com/andock/ssh2docksal"
+	"github.com/apex/log"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type hostMount struct {
+	containerPath string
+	hostPath      string
+	readOnly      bool
+}
+
+// getHostMounts returns the bind mounts of the container which are visible to ssh2docksal.
+func getHostMounts(containerID string, config ssh2docksal.Config) []hostMount {
+	if !config.HostMounts {
+		return nil
+	}
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		log.Errorf("Couldn't connect to docker")
+		return nil
+	}
+	info, err := cli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		log.Errorf("SFTP: Unable to inspect %s: %s", containerID, err.Error())
+		return nil
+	}
+	mounts := []hostMount{}
+	for _, m := range info.Mounts {
+		if m.Type != mount.TypeBind {
+			continue
+		}
+		hostPath, err := filepath.EvalSymlinks(filepath.Join(config.HostRoot, m.Source))
+		if err != nil {
+			log.Debugf("SFTP: Bind mount %s is not visible at %s", m.Destination, filepath.Join(config.HostRoot, m.Source))
+			continue
+		}
+		if stat, err := os.Stat(hostPath); err != nil || !stat.IsDir() {
+			continue
+		}
+		log.Debugf("SFTP: Serve %s from host folder %s", m.Destination, hostPath)
+		mounts = append(mounts, hostMount{containerPath: filepath.Clean(m.Destination), hostPath: hostPath, readOnly: !m.RW})
+	}
+	// Nested mounts first.
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i].containerPath) > len(mounts[j].containerPath)
+	})
+	return mounts
+}
+
+// oPath is O_PATH of Linux, which is missing in package syscall.
+const oPath = 0x200000
+
+// maxSymlinks limits the symlinks followed by a lookup like the kernel does.
+const maxSymlinks = 40
+
+// errOutsideMount is returned by lookups which lead out of the host mount, the container resolves them.
+var errOutsideMount = errors.New("Path leads out of the host mount")
+
+// hostRef is a path below a host mount. Its folder is held open and the
+// operations address the path relative to it without following a symlink in
+// its place, so components swapped for symlinks after the lookup can't lead
+// out of the mount. The operations run with the permissions of the exec user.
+type hostRef struct {
+	fs            *root
+	m             *hostMount
+	containerPath string
+	dir           *os.File
+	name          string
+	// err is the error of the lookup, e.g. of a missing folder. It is returned by all operations.
+	err error
+}
+
+// mountOf returns the host mount of a container path and the path relative to it.
+func (fs *root) mountOf(containerPath string) (*hostMount, string) {
+	containerPath = filepath.Clean(containerPath)
+	for i := range fs.mounts {
+		m := &fs.mounts[i]
+		rel, err := filepath.Rel(m.containerPath, containerPath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return m, rel
+		}
+	}
+	return nil, ""
+}
+
+// hostLookup resolves a container path below a host mount. A symlink in the
+// last component is followed if follow is set, missing folders are created if
+// mkdir is set. Returns nil if the path is not served from the host.
+func (fs *root) hostLookup(containerPath string, follow bool, mkdir bool) *hostRef {
+	m, rel := fs.mountOf(containerPath)
+	if m == nil {
+		return nil
+	}
+	if uid, _ := fs.execUser(); uid < 0 {
+		// The permissions of the exec user can't be applied.
+		return nil
+	}
+	var mode os.FileMode
+	if mkdir && !m.readOnly {
+		mode = fs.newDirMode()
+	}
+	top, err := os.OpenFile(m.hostPath, oPath|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		log.Debugf("SFTP: Unable to open host folder %s: %s", m.hostPath, err.Error())
+		return nil
+	}
+	ref := &hostRef{fs: fs, m: m, containerPath: filepath.Clean(containerPath)}
+	err = fs.asExecUser(func() error {
+		var err error
+		ref.dir, ref.name, err = fs.walk(m, top, rel, follow, mode)
+		return err
+	})
+	if err == errOutsideMount {
+		return nil
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		pathErr.Path = ref.containerPath
+	}
+	ref.err = err
+	return ref
+}
+
+// hostPath resolves a container path below a host mount. A symlink in the last
+// component is not followed. Returns nil if the path is not served from the host.
+func (fs *root) hostPath(containerPath string) *hostRef {
+	return fs.hostLookup(containerPath, false, false)
+}
+
+// hostFile resolves a container path below a host mount following symlinks.
+// Returns nil if the path is not served from the host.
+func (fs *root) hostFile(containerPath string) *hostRef {
+	return fs.hostLookup(containerPath, true, false)
+}
+
+// walk looks up rel in the host folder top of m one component at a time
+// without following symlinks. Symlinks are resolved here instead, relative
+// targets from their folder and absolute ones as container paths. Both have
+// to stay in the mount. Returns the open folder of the last component and its
+// name, "." for the folder itself. Missing folders are created with mkdir
+// unless it is 0.
+func (fs *root) walk(m *hostMount, top *os.File, rel string, follow bool, mkdir os.FileMode) (*os.File, string, error) {
+	folders := []*os.File{top}
+	done := func(dir *os.File, name string, err error) (*os.File, string, error) {
+		for _, folder := range folders {
+			if folder != dir {
+				folder.Close()
+			}
+		}
+		return dir, name, err
+	}
+	parts := splitHostPath(rel)
+	links := 0
+	for len(parts) > 0 {
+		part, last := parts[0], len(parts) == 1
+		parts = parts[1:]
+		dir := folders[len(folders)-1]
+		if part == ".." {
+			if len(folders) == 1 {
+				return done(nil, "", errOutsideMount)
+			}
+			dir.Close()
+			folders = folders[:len(folders)-1]
+			continue
+		}
+		fd, err := syscall.Openat(int(dir.Fd()), part, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err == syscall.ENOENT && !last && mkdir != 0 {
+			fd, err = mkdirAt(dir, part, mkdir)
+		}
+		if err == syscall.ENOENT && last {
+			return done(dir, part, nil)
+		}
+		if err != nil {
+			return done(nil, "", &os.PathError{Op: "lookup", Err: err})
+		}
+		var stat syscall.Stat_t
+		err = syscall.Fstat(fd, &stat)
+		switch {
+		case err != nil:
+			syscall.Close(fd)
+			return done(nil, "", &os.PathError{Op: "lookup", Err: err})
+		case stat.Mode&syscall.S_IFMT == syscall.S_IFLNK && (follow || !last):
+			syscall.Close(fd)
+			if links++; links > maxSymlinks {
+				return done(nil, "", &os.PathError{Op: "lookup", Err: syscall.ELOOP})
+			}
+			target, err := os.Readlink(fdPath(int(dir.Fd()), part))
+			if err != nil {
+				return done(nil, "", err)
+			}
+			if path.IsAbs(target) {
+				targetMount, targetRel := fs.mountOf(target)
+				if targetMount != m {
+					return done(nil, "", errOutsideMount)
+				}
+				for _, folder := range folders[1:] {
+					folder.Close()
+				}
+				folders, target = folders[:1], targetRel
+			}
+			parts = append(splitHostPath(target), parts...)
+		case last:
+			syscall.Close(fd)
+			return done(dir, part, nil)
+		case stat.Mode&syscall.S_IFMT != syscall.S_IFDIR:
+			syscall.Close(fd)
+			return done(nil, "", &os.PathError{Op: "lookup", Err: syscall.ENOTDIR})
+		default:
+			folders = append(folders, os.NewFile(uintptr(fd), part))
+		}
+	}
+	return done(folders[len(folders)-1], ".", nil)
+}
+
+// splitHostPath returns the components of a relative path without empty and "." components.
+func splitHostPath(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// fdPath returns the path of name in the open folder fd, of the open file itself if name is empty.
+func fdPath(fd int, name string) string {
+	fdPath := "/proc/self/fd/" + strconv.Itoa(fd)
+	if name == "" {
+		return fdPath
+	}
+	return fdPath + "/" + name
+}
+
+// mkdirAt creates the folder name in dir with mode and opens it like walk.
+func mkdirAt(dir *os.File, name string, mode os.FileMode) (int, error) {
+	err := syscall.Mkdirat(int(dir.Fd()), name, uint32(mode.Perm()))
+	if err != nil && err != syscall.EEXIST {
+		return -1, err
+	}
+	fd, openErr := syscall.Openat(int(dir.Fd()), name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err == nil && openErr == nil {
+		// The umask of ssh2docksal must not apply.
+		os.Chmod(fdPath(fd, ""), mode)
+	}
+	return fd, openErr
+}
+
+// asExecUser runs op with the file system uid and gid of the exec user, so the
+// kernel checks the permissions of host files like in the container. The
+// supplementary groups of the exec user don't apply. Without root ssh2docksal
+// can't switch and op runs with its own permissions.
+func (fs *root) asExecUser(op func() error) error {
+	uid, gid := fs.execUser()
+	if uid <= 0 || os.Geteuid() != 0 {
+		return op()
+	}
+	runtime.LockOSThread()
+	// setfsuid and setfsgid return the previous id, the second call confirms the change.
+	syscall.Syscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	syscall.Syscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	currentGID, _, _ := syscall.Syscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	currentUID, _, _ := syscall.Syscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	defer func() {
+		syscall.Syscall(syscall.SYS_SETFSUID, 0, 0, 0)
+		syscall.Syscall(syscall.SYS_SETFSGID, 0, 0, 0)
+		runtime.UnlockOSThread()
+	}()
+	if int(currentUID) != uid || int(currentGID) != gid {
+		return os.ErrPermission
+	}
+	return op()
+}
+
+// Close releases the folder of the path.
+func (ref *hostRef) Close() {
+	if ref.dir != nil {
+		ref.dir.Close()
+	}
+}
+
+// do runs op as the exec user with a path of ref relative to its open folder.
+// Errors name the container path.
+func (ref *hostRef) do(op func(path string) error) error {
+	if ref.err != nil {
+		return ref.err
+	}
+	err := ref.fs.asExecUser(func() error {
+		return op(fdPath(int(ref.dir.Fd()), ref.name))
+	})
+	if pathErr, ok := err.(*os.PathError); ok {
+		pathErr.Path = ref.containerPath
+	}
+	return err
+}
+
+// object runs op like do with a path of the file itself, which doesn't follow
+// a symlink swapped in after the lookup.
+func (ref *hostRef) object(op func(path string) error) error {
+	return ref.do(func(path string) error {
+		fd, err := syscall.Open(path, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Err: err}
+		}
+		defer syscall.Close(fd)
+		return op(fdPath(fd, ""))
+	})
+}
+
+// Lstat returns the file info of ref.
+func (ref *hostRef) Lstat() (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := ref.do(func(path string) (err error) {
+		fi, err = os.Lstat(path)
+		return err
+	})
+	return fi, err
+}
+
+// Open opens ref, failing if it is a symlink.
+func (ref *hostRef) Open(flags int, mode os.FileMode) (*os.File, error) {
+	var file *os.File
+	err := ref.do(func(path string) (err error) {
+		file, err = os.OpenFile(path, flags|syscall.O_NOFOLLOW, mode)
+		return err
+	})
+	return file, err
+}
+
+// ReadDir returns the file infos of the folder ref sorted by name.
+func (ref *hostRef) ReadDir() ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := ref.do(func(path string) error {
+		folder, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer folder.Close()
+		infos, err = folder.Readdir(-1)
+		return err
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, err
+}
+
+// Rename renames ref to target in the same mount.
+func (ref *hostRef) Rename(target *hostRef) error {
+	if target.err != nil {
+		return target.err
+	}
+	return ref.do(func(path string) error {
+		return os.Rename(path, fdPath(int(target.dir.Fd()), target.name))
+	})
+}
+
+// Link creates the hardlink ref of target in the same mount.
+func (ref *hostRef) Link(target *hostRef) error {
+	if target.err != nil {
+		return target.err
+	}
+	return ref.do(func(path string) error {
+		return os.Link(fdPath(int(target.dir.Fd()), target.name), path)
+	})
+}
+
+// newHostFile converts the file info of a host file.
+func newHostFile(containerPath string, fi os.FileInfo, containerID string) *dockerFile {
+	file := newDockerFile(containerPath, fi.IsDir(), containerID)
+	file.modtime = fi.ModTime()
+	file.size = fi.Size()
+	file.mode = fi.Mode()
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		file.uid = sys.Uid
+		file.gid = sys.Gid
+	}
+	file.hasStat = true
+	return file
+}
+
+func (fs *root) hostFileInfo(containerPath string, ref *hostRef) (*dockerFile, error) {
+	fi, err := ref.Lstat()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return newHostFile(containerPath, fi, fs.containerID), nil
+}
+
+func (fs *root) hostFileList(folder *dockerFile, ref *hostRef) ([]os.FileInfo, error) {
+	infos, err := ref.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+	validItems := []os.FileInfo{}
+	for _, fi := range infos {
+		item := newHostFile(filepath.Join(folder.name, fi.Name()), fi, fs.containerID)
+		fs.cache(item.name, item)
+		validItems = append(validItems, item)
+	}
+	return validItems, nil
+}
+
+// hostFileCreate opens a host file for writing. New files are created by the
+// exec user, missing folders by the lookup.
+func (fs *root) hostFileCreate(ref *hostRef, truncate bool) (*os.File, error) {
+	if ref.m.readOnly {
+		return nil, os.ErrPermission
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	file, err := ref.Open(flags|os.O_EXCL, fs.newFileMode())
+	if os.IsExist(err) {
+		return ref.Open(flags, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The umask of ssh2docksal must not apply.
+	file.Chmod(fs.newFileMode())
+	return file, nil
+}
+
+// hostAtomicFile is an upload to a temp file which replaces the target on close.
+type hostAtomicFile struct {
+	*os.File
+	file *dockerFile
+	// ref is the target, temp the temp file in the same folder.
+	ref    *hostRef
+	temp   *hostRef
+	failed bool
+}
+
+// hostAtomicCreate opens a temp file next to ref for an atomic upload.
+// Permissions and owner of an existing target are kept as far as the exec user may.
+func (fs *root) hostAtomicCreate(ref *hostRef, truncate bool) (*hostAtomicFile, error) {
+	if ref.m.readOnly {
+		return nil, os.ErrPermission
+	}
+	name, err := atomicUploadName(ref.name)
+	if err != nil {
+		return nil, err
+	}
+	temp := &hostRef{fs: fs, m: ref.m, containerPath: filepath.Join(filepath.Dir(ref.containerPath), name), dir: ref.dir, name: name, err: ref.err}
+	file, err := temp.Open(os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	atomicFile := &hostAtomicFile{File: file, ref: ref, temp: temp}
+	stat, err := ref.Lstat()
+	if os.IsNotExist(err) {
+		file.Chmod(fs.newFileMode())
+		return atomicFile, nil
+	}
+	if err == nil {
+		mode := stat.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+			file.Chown(int(sys.Uid), int(sys.Gid))
+			if !fs.keepsSetID(int(sys.Uid)) {
+				mode &^= os.ModeSetuid | os.ModeSetgid
+			}
+		}
+		// After the chown, which clears setuid and setgid.
+		file.Chmod(mode)
+		if !truncate {
+			var existing *os.File
+			if existing, err = ref.Open(os.O_RDONLY, 0); err == nil {
+				_, err = io.Copy(file, existing)
+				existing.Close()
+			}
+		}
+	}
+	if err != nil {
+		atomicFile.failed = true
+		atomicFile.discard()
+		return nil, err
+	}
+	return atomicFile, nil
+}
+
+func (f *hostAtomicFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.file != nil {
+		if err := f.file.checkWrite(off, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// TransferError is called by the sftp request server if the connection dropped.
+func (f *hostAtomicFile) TransferError(err error) {
+	f.failed = true
+}
+
+func (f *hostAtomicFile) setstat(attrs *fileAttrs) error {
+	return f.temp.object(func(path string) error {
+		if err := f.temp.fs.restrictHostAttrs(path, attrs); err != nil {
+			return err
+		}
+		return setHostAttrs(path, attrs)
+	})
+}
+
+// Close renames the temp file over the target. Interrupted uploads are removed.
+func (f *hostAtomicFile) Close() error {
+	if f.file != nil {
+		f.file.root.finishUpload(f.file, f)
+	}
+	err := f.File.Close()
+	if err == nil && !f.failed {
+		if err = f.temp.Rename(f.ref); err == nil {
+			if f.file != nil {
+				f.file.root.changed(f.file.name)
+			}
+			f.ref.Close()
+			return nil
+		}
+	}
+	f.discard()
+	return err
+}
+
+// discard removes the temp file and releases the target.
+func (f *hostAtomicFile) discard() {
+	f.File.Close()
+	f.temp.do(syscall.Unlink)
+	f.ref.Close()
+}
+
+// hostMkDir creates the folder ref. Missing parents were created by the lookup if parents is set.
+func (fs *root) hostMkDir(ref *hostRef, parents bool) error {
+	if ref.m.readOnly {
+		return os.ErrPermission
+	}
+	return ref.do(func(path string) error {
+		if err := os.Mkdir(path, fs.newDirMode()); err != nil {
+			if fi, statErr := os.Lstat(path); parents && os.IsExist(err) && statErr == nil && fi.IsDir() {
+				return nil
+			}
+			return err
+		}
+		// The umask of ssh2docksal must not apply.
+		return chmodNoFollow(path, fs.newDirMode())
+	})
+}
+
+// chmodNoFollow changes the mode of path, which is not followed if it is a symlink.
+func chmodNoFollow(path string, mode os.FileMode) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+	return os.Chmod(fdPath(fd, ""), mode)
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestHostPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	project := filepath.Join(dir, "project")
+	files := filepath.Join(dir, "files")
+	os.MkdirAll(filepath.Join(project, "docroot"), 0755)
+	os.MkdirAll(files, 0755)
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(project, "escape"))
+	os.Symlink("docroot", filepath.Join(project, "inside"))
+	os.Symlink("../..", filepath.Join(project, "docroot/up"))
+	os.Symlink("/var/www/docroot", filepath.Join(project, "absolute"))
+
+	fs := &root{mounts: []hostMount{
+		{containerPath: "/var/www/docroot/files", hostPath: files},
+		{containerPath: "/var/www", hostPath: project},
+	}, userLoaded: true, uid: os.Getuid(), gid: os.Getgid()}
+
+	tests := []struct {
+		containerPath string
+		hostPath      string
+	}{
+		{containerPath: "/var/www", hostPath: project},
+		{containerPath: "/var/www/docroot/index.php", hostPath: filepath.Join(project, "docroot/index.php")},
+		{containerPath: "/var/www/docroot/files/a.jpg", hostPath: filepath.Join(files, "a.jpg")},
+		{containerPath: "/var/www/inside/index.php", hostPath: filepath.Join(project, "docroot/index.php")},
+		{containerPath: "/var/www/absolute/index.php", hostPath: filepath.Join(project, "docroot/index.php")},
+		{containerPath: "/var/www/inside", hostPath: filepath.Join(project, "inside")},
+		{containerPath: "/var/www/escape", hostPath: filepath.Join(project, "escape")},
+		{containerPath: "/var/www/escape/passwd", hostPath: ""},
+		{containerPath: "/var/www/escape/new/file.txt", hostPath: ""},
+		{containerPath: "/var/www/docroot/up/etc", hostPath: ""},
+		{containerPath: "/var/wwwroot/index.php", hostPath: ""},
+		{containerPath: "/etc/passwd", hostPath: ""},
+	}
+
+	for _, test := range tests {
+		if hostPath := resolvedHostPath(t, fs.hostPath(test.containerPath)); hostPath != test.hostPath {
+			t.Errorf("Host path of %s should be %q, got %q", test.containerPath, test.hostPath, hostPath)
+		}
+	}
+	if hostPath := resolvedHostPath(t, fs.hostFile("/var/www/inside")); hostPath != filepath.Join(project, "docroot") {
+		t.Errorf("Symlinks should be followed, got %q", hostPath)
+	}
+	if hostPath := resolvedHostPath(t, fs.hostFile("/var/www/escape")); hostPath != "" {
+		t.Errorf("Symlinks out of the mount should not be served from the host, got %q", hostPath)
+	}
+	if ref := fs.hostPath("/var/www/new/folder/file.txt"); ref == nil || !os.IsNotExist(ref.err) {
+		t.Errorf("Missing folders should fail the lookup")
+	}
+	ref := fs.hostLookup("/var/www/new/folder/file.txt", true, true)
+	if hostPath := resolvedHostPath(t, ref); hostPath != filepath.Join(project, "new/folder/file.txt") {
+		t.Errorf("Missing folders should be created, got %q", hostPath)
+	}
+}
+
+// resolvedHostPath returns the host path ref resolved to, "" for nil.
+func resolvedHostPath(t *testing.T, ref *hostRef) string {
+	if ref == nil {
+		return ""
+	}
+	defer ref.Close()
+	if ref.err != nil {
+		t.Fatal(ref.err)
+	}
+	dir, err := os.Readlink(fdPath(int(ref.dir.Fd()), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, ref.name)
+}
+
+func TestHostSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	project := filepath.Join(dir, "project")
+	os.MkdirAll(filepath.Join(project, "docroot"), 0755)
+	os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "outside/secret"), []byte("secret"), 0644)
+	ioutil.WriteFile(filepath.Join(project, "docroot/secret"), []byte("public"), 0644)
+	fs := &root{
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: project}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+
+	ref := fs.hostFile("/var/www/docroot/secret")
+	if ref == nil {
+		t.Fatal("Expected the file to be served from the host")
+	}
+	defer ref.Close()
+	// Swap the folder for a symlink out of the mount after the lookup.
+	os.Rename(filepath.Join(project, "docroot"), filepath.Join(project, "moved"))
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(project, "docroot"))
+	file, err := ref.Open(os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if content, _ := ioutil.ReadAll(file); string(content) != "public" {
+		t.Errorf("Expected the looked up file, got %q", content)
+	}
+	if ref := fs.hostFile("/var/www/docroot/secret"); ref != nil {
+		ref.Close()
+		t.Errorf("Expected the swapped symlink to be left to the container")
+	}
+}
+
+func TestHostExecUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Switching to the exec user needs root")
+	}
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "private"), []byte("root only"), 0600)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: 1000, gid: 1000,
+	}
+
+	if _, err := fs.openReader(newDockerFile("/var/www/private", false, "")); !os.IsPermission(err) {
+		t.Errorf("Expected the exec user not to read files of root, got %v", err)
+	}
+	if err := fs.execMkDir("/var/www/folder", false); !os.IsPermission(err) {
+		t.Errorf("Expected the exec user not to write folders of root, got %v", err)
+	}
+	os.Chmod(dir, 0777)
+	if err := fs.execMkDir("/var/www/folder", false); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(filepath.Join(dir, "folder")); stat.Sys().(*syscall.Stat_t).Uid != 1000 {
+		t.Errorf("Expected new folders to be owned by the exec user")
+	}
+}
+
+func TestHostAtomicCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &root{
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+	target := filepath.Join(dir, "index.php")
+	ioutil.WriteFile(target, []byte("old content"), 0640)
+
+	file, err := fs.hostAtomicCreate(fs.hostFile("/var/www/index.php"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("new"), 0)
+	if content, _ := ioutil.ReadFile(target); string(content) != "old content" {
+		t.Errorf("Target should not change before close, got %q", content)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(target)
+	stat, _ := os.Stat(target)
+	if string(content) != "new" || stat.Mode().Perm() != 0640 {
+		t.Errorf("Close should replace the target keeping the permissions, got %q %s", content, stat.Mode())
+	}
+
+	file, err = fs.hostAtomicCreate(fs.hostFile("/var/www/index.php"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte(" appended"), 3)
+	file.TransferError(io.ErrUnexpectedEOF)
+	file.Close()
+	if content, _ := ioutil.ReadFile(target); string(content) != "new" {
+		t.Errorf("Interrupted uploads should not replace the target, got %q", content)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Interrupted uploads should be removed, got %d files", len(entries))
+	}
+}
+
+func TestHostRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+	if err := fs.execMkDir("/var/www/a/b", false); err == nil {
+		t.Errorf("Mkdir without parents should fail if the parent is missing")
+	}
+	if err := fs.execMkDir("/var/www/a/b", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.execMkDir("/var/www/a", false); !os.IsExist(err) {
+		t.Errorf("Mkdir of an existing folder should fail, got %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "ab"), []byte("sibling"), 0644)
+
+	a, _ := fs.fetch("/var/www/a")
+	b, _ := fs.fetch("/var/www/a/b")
+	ab, _ := fs.fetch("/var/www/ab")
+	if err := a.execRmdir(); err == nil {
+		t.Errorf("Rmdir should refuse folders which are not empty")
+	}
+	if err := a.execRemove(); err == nil {
+		t.Errorf("Remove should refuse folders")
+	}
+	if err := ab.execRmdir(); err == nil {
+		t.Errorf("Rmdir should refuse files")
+	}
+	if err := b.execRmdir(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.execRmdir(); err != nil {
+		t.Fatal(err)
+	}
+	fs.forget("/var/www/a")
+	if _, ok := fs.files["/var/www/a/b"]; ok {
+		t.Errorf("Forget should drop descendants")
+	}
+	if _, ok := fs.files["/var/www/ab"]; !ok {
+		t.Errorf("Forget should keep siblings with the same prefix")
+	}
+	if err := ab.execRemove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "ab")); !os.IsNotExist(err) {
+		t.Errorf("Remove should delete the file")
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// hostileNames are file names which break out of naively quoted shell commands.
+var hostileNames = []string{
+	"x'; touch canary-quote; '",
+	`x"; touch canary-dquote; "`,
+	"$(touch canary-subst)",
+	"`touch canary-backtick`",
+	"x; touch canary-semicolon",
+	"x && touch canary-and",
+	"x | touch canary-pipe",
+	"new\nline",
+	"tab\tname",
+	"-rf",
+	"--help",
+	"-n 1",
+	"*",
+	"\\",
+	"$HOME",
+	"a b  c ",
+	"ünïcödé",
+}
+
+func TestClientHostileFileNames(t *testing.T) {
+	sftp, cmd := testClient(t, READWRITE, NO_DELAY)
+	defer cmd.Wait()
+	defer sftp.Close()
+
+	dir, err := ioutil.TempDir("", "sftptest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	canary := path.Join(dir, "canary")
+	if err := ioutil.WriteFile(canary, []byte("canary"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range hostileNames {
+		file := path.Join(dir, name)
+		f, err := sftp.Create(file)
+		if err != nil {
+			t.Errorf("Create(%q): %s", name, err)
+			continue
+		}
+		if _, err := f.Write([]byte("hostile")); err != nil {
+			t.Errorf("Write(%q): %s", name, err)
+		}
+		f.Close()
+		if stat, err := sftp.Lstat(file); err != nil || stat.Name() != name || stat.Size() != 7 {
+			t.Errorf("Lstat(%q): got %v %v", name, stat, err)
+		}
+		if err := sftp.Chmod(file, 0600); err != nil {
+			t.Errorf("Chmod(%q): %s", name, err)
+		}
+		if err := sftp.Truncate(file, 3); err != nil {
+			t.Errorf("Truncate(%q): %s", name, err)
+		}
+		renamed := path.Join(dir, name+".renamed")
+		if err := sftp.Rename(file, renamed); err != nil {
+			t.Errorf("Rename(%q): %s", name, err)
+		}
+		folder := path.Join(dir, "dir "+name)
+		if err := sftp.Mkdir(folder); err != nil {
+			t.Errorf("Mkdir(%q): %s", name, err)
+		}
+		entries, err := sftp.ReadDir(dir)
+		if err != nil {
+			t.Errorf("ReadDir after %q: %s", name, err)
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.Name() == name+".renamed" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("ReadDir should list %q", name+".renamed")
+		}
+		if err := sftp.Remove(renamed); err != nil {
+			t.Errorf("Remove(%q): %s", name, err)
+		}
+	}
+	if _, err := os.Stat(canary); err != nil {
+		t.Errorf("Canary file was removed: %s", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "canary" && !strings.HasPrefix(entry.Name(), "dir ") {
+			t.Errorf("Unexpected file %q, a command was injected", entry.Name())
+		}
+	}
+}
@@ -156,7 +156,8 @@ func testClientGoSvr(t testing.TB, readonly bool, delay time.Duration) (*sftp.Cl
 		containerID = getReadOnlyTestContainerId()
 	}
 	c := ssh2docksal.Config{DockerUser:"docker"}
-	server := sftp.NewRequestServer(c1, DockerCliSftpHandler(containerID, c))
+	handlers := DockerCliSftpHandler(containerID, c)
+	server := sftp.NewRequestServer(handlers.FileCmd.(ssh2docksal.SftpExtensionHandler).SftpChannel(c1), handlers)
 	//err := server.Serve()
 	//server, err := sftp.NewServer(c1, options...)
 	//if err != nil {
@@ -251,7 +252,6 @@ func TestClientMkdir(t *testing.T) {
 	if err := sftp.Mkdir(sub); err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(2 * time.Second)
 	if _, err := os.Lstat(sub); err != nil {
 		t.Fatal(err)
 	}
@@ -269,7 +269,6 @@ func TestClientMkdirAll(t *testing.T) {
 	if err := sftp.MkdirAll(sub); err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(2 * time.Second)
 	info, err := os.Lstat(sub)
 	if err != nil {
 		t.Fatal(err)
@@ -589,7 +588,6 @@ func TestClientRemove(t *testing.T) {
 	if err := sftp.Remove(f.Name()); err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(2 * time.Second)
 	if _, err := os.Lstat(f.Name()); !os.IsNotExist(err) {
 		t.Fatal(err)
 	}
@@ -607,14 +605,13 @@ func TestClientRemoveDir(t *testing.T) {
 	if err := sftp.Remove(dir); err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(2 * time.Second)
 	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
 		t.Fatal(err)
 	}
 }
 
 func TestClientRemoveFailed(t *testing.T) {
-	t.Skip("skipping intergration test. Permission checking not supported. Remove is asyncron")
+	t.Skip("skipping intergration test. Permission checking not supported.")
 	sftp, cmd := testClient(t, READONLY, NO_DELAY)
 	defer cmd.Wait()
 	defer sftp.Close()
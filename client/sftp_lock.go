@@ -0,0 +1,83 @@
+package client
+
+// Locking of the sftp sessions. Requests on different paths run concurrently,
+// requests on the same path are serialized. filesLock only guards the cache and
+// is never held during docker round trips.
+
+import (
+	"sort"
+	"sync"
+)
+
+// pathLocks holds the locks of the paths currently in use by a session.
+type pathLocks struct {
+	lock  sync.Mutex
+	paths map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (l *pathLocks) acquire(path string) *pathLock {
+	l.lock.Lock()
+	if l.paths == nil {
+		l.paths = make(map[string]*pathLock)
+	}
+	p, ok := l.paths[path]
+	if !ok {
+		p = &pathLock{}
+		l.paths[path] = p
+	}
+	p.refs++
+	l.lock.Unlock()
+	p.Lock()
+	return p
+}
+
+func (l *pathLocks) release(path string, p *pathLock) {
+	p.Unlock()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if p.refs--; p.refs == 0 {
+		delete(l.paths, path)
+	}
+}
+
+// lockPaths locks the given paths in a fixed order and returns the unlock function.
+// Empty paths are ignored.
+func (fs *root) lockPaths(paths ...string) func() {
+	sorted := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path != "" {
+			sorted = append(sorted, path)
+		}
+	}
+	sort.Strings(sorted)
+	var names []string
+	var locks []*pathLock
+	for i, path := range sorted {
+		if i > 0 && sorted[i-1] == path {
+			continue
+		}
+		names = append(names, path)
+		locks = append(locks, fs.locks.acquire(path))
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			fs.locks.release(names[i], locks[i])
+		}
+	}
+}
+
+// execSlot waits until less than Config.SftpMaxExecs requests of the session
+// talk to docker and returns the function releasing the slot. Path locks have
+// to be taken before the slot.
+func (fs *root) execSlot() func() {
+	fs.execOnce.Do(func() {
+		fs.execSlots = make(chan struct{}, fs.config.GetSftpMaxExecs())
+	})
+	fs.execSlots <- struct{}{}
+	return func() { <-fs.execSlots }
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"fmt"
+	"github.com/andock/ssh2docksal"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blocked reports whether done is still open after a short wait.
+func blocked(done chan struct{}) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+func TestLockPaths(t *testing.T) {
+	fs := &root{files: make(map[string]*dockerFile)}
+	unlock := fs.lockPaths("/var/www/a")
+
+	other := make(chan struct{})
+	go func() {
+		fs.lockPaths("/var/www/b")()
+		close(other)
+	}()
+	if blocked(other) {
+		t.Errorf("Requests on other paths should not wait")
+	}
+
+	same := make(chan struct{})
+	go func() {
+		fs.lockPaths("/var/www/b", "/var/www/a", "")()
+		close(same)
+	}()
+	if !blocked(same) {
+		t.Errorf("Requests on the same path should wait")
+	}
+	unlock()
+	if blocked(same) {
+		t.Errorf("Requests should continue after the unlock")
+	}
+	if len(fs.locks.paths) != 0 {
+		t.Errorf("Expected unused locks to be dropped, got %d", len(fs.locks.paths))
+	}
+}
+
+func TestExecSlot(t *testing.T) {
+	fs := &root{config: ssh2docksal.Config{SftpMaxExecs: 2}}
+	release := fs.execSlot()
+	fs.execSlot()
+
+	done := make(chan struct{})
+	go func() {
+		fs.execSlot()()
+		close(done)
+	}()
+	if !blocked(done) {
+		t.Errorf("Expected the third exec to wait")
+	}
+	release()
+	if blocked(done) {
+		t.Errorf("Expected the exec to continue after a release")
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.txt", i)), []byte("content"), 0644)
+	}
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		config:     ssh2docksal.Config{SftpCacheTTL: time.Minute, SftpMaxExecs: 2},
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+	fs.dockerFile = newDockerFile("/", true, "")
+	fs.dockerFile.root = fs
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("/var/www/%d.txt", i)
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if _, err := fs.Filelist(sftp.NewRequest("List", "/var/www")); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := fs.Filelist(sftp.NewRequest("Stat", name)); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			reader, err := fs.Fileread(sftp.NewRequest("Get", name))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			reader.(*os.File).Close()
+		}()
+	}
+	wg.Wait()
+	// The files and the folder.
+	if len(fs.files) != 11 {
+		t.Errorf("Expected 11 cached files, got %d", len(fs.files))
+	}
+}
@@ -0,0 +1,271 @@
+package client
+
+// Sftp policies in front of the file system of a session. Paths of the client
+// are below the root of the policy, denied paths and changes of read-only
+// sessions return permission denied. Symlinks can only be created inside of
+// the root. Paths are checked with their symlinks resolved as well, so links
+// don't lead out of the root or to denied paths.
+
+import (
+	"github.com/andock/ssh2docksal"
+	"github.com/apex/log"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// policyFS implements the sftp handlers of a restricted session.
+type policyFS struct {
+	fs     *root
+	policy ssh2docksal.SftpPolicy
+}
+
+func newPolicyFS(fs *root, policy ssh2docksal.SftpPolicy) *policyFS {
+	if policy.Root == "" {
+		policy.Root = "/"
+	}
+	return &policyFS{fs: fs, policy: policy}
+}
+
+// containerPath maps a path of the client to the container.
+func (p *policyFS) containerPath(name string) string {
+	return path.Join(p.policy.Root, path.Clean("/"+name))
+}
+
+// clientPath maps a container path to the client. Paths outside of the root are returned unchanged.
+func (p *policyFS) clientPath(name string) string {
+	if p.policy.Root == "/" || !path.IsAbs(name) {
+		return name
+	}
+	if name == p.policy.Root {
+		return "/"
+	}
+	if strings.HasPrefix(name, p.policy.Root+"/") {
+		return name[len(p.policy.Root):]
+	}
+	return name
+}
+
+// jailedPath maps a container path to the client. Paths outside of the root become the root.
+func (p *policyFS) jailedPath(name string) string {
+	if mapped := p.clientPath(name); mapped != name || p.policy.Root == "/" {
+		return mapped
+	}
+	return "/"
+}
+
+// denied checks if the container path or one of its folders matches a deny pattern.
+func (p *policyFS) denied(name string) bool {
+	for folder := name; folder != "/" && folder != "."; folder = path.Dir(folder) {
+		for _, pattern := range p.policy.Deny {
+			subject := path.Base(folder)
+			if strings.Contains(pattern, "/") {
+				subject = folder
+			}
+			if ok, _ := path.Match(pattern, subject); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deniesBelow checks if a deny pattern of container paths matches paths below
+// the container path name, which a rename of name would move out of the pattern.
+func (p *policyFS) deniesBelow(name string) bool {
+	nameParts := strings.Split(strings.Trim(name, "/"), "/")
+	if name == "/" {
+		nameParts = nil
+	}
+	for _, pattern := range p.policy.Deny {
+		if !strings.HasPrefix(pattern, "/") {
+			// Names match wherever they are moved.
+			continue
+		}
+		patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+		if len(patternParts) <= len(nameParts) {
+			continue
+		}
+		matches := true
+		for i, part := range nameParts {
+			if ok, _ := path.Match(patternParts[i], part); !ok {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// inRoot checks if the container path is the root of the policy or below it.
+func (p *policyFS) inRoot(name string) bool {
+	return p.policy.Root == "/" || name == p.policy.Root || strings.HasPrefix(name, p.policy.Root+"/")
+}
+
+// resolve returns the container path name with the symlinks of its folders
+// resolved like realpath -m in the container, the last component only if
+// follow is set. Missing components are kept. The root of the policy itself
+// is not resolved. The components are looked up without the metadata cache, a
+// symlink changed by the container since it was cached must not slip through.
+func (p *policyFS) resolve(name string, follow bool) (string, error) {
+	if !p.inRoot(name) {
+		return name, nil
+	}
+	resolved := p.policy.Root
+	parts := splitHostPath(strings.TrimPrefix(name, p.policy.Root))
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		if len(parts) == 0 && !follow {
+			return next, nil
+		}
+		file, err := p.fs.execFileInfo(next)
+		if os.IsNotExist(err) {
+			return path.Join(next, path.Join(parts...)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !file.isSymlink() {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: syscall.ELOOP}
+		}
+		target, err := p.fs.execReadlink(file)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(splitHostPath(target), parts...)
+	}
+	return resolved, nil
+}
+
+// check returns permission denied if the policy doesn't allow the access of
+// the container path. Symlinks of its folders are resolved, the last component
+// is followed if follow is set.
+func (p *policyFS) check(name string, write bool, follow bool) error {
+	if write && p.policy.ReadOnly || p.denied(name) {
+		log.Debugf("SFTP: Policy denies access to %s", name)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if p.policy.Root == "/" && len(p.policy.Deny) == 0 {
+		return nil
+	}
+	resolved, err := p.resolve(name, follow)
+	if err != nil {
+		return err
+	}
+	if !p.inRoot(resolved) || p.denied(resolved) {
+		log.Debugf("SFTP: Policy denies access to %s resolved to %s", name, resolved)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return nil
+}
+
+// request returns the request with the paths mapped to the container.
+func (p *policyFS) request(r *sftp.Request) *sftp.Request {
+	req := sftp.NewRequest(r.Method, p.containerPath(r.Filepath))
+	req.Flags, req.Attrs = r.Flags, r.Attrs
+	if r.Target != "" {
+		req.Target = p.containerPath(r.Target)
+	}
+	return req
+}
+
+func (p *policyFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	req := p.request(r)
+	if err := p.check(req.Filepath, false, true); err != nil {
+		return nil, err
+	}
+	return p.fs.Fileread(req)
+}
+
+func (p *policyFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	req := p.request(r)
+	if err := p.check(req.Filepath, true, true); err != nil {
+		p.fs.config.Audit("write", req.Filepath, "", 0, err)
+		return nil, err
+	}
+	return p.fs.Filewrite(req)
+}
+
+func (p *policyFS) Filecmd(r *sftp.Request) error {
+	// The target of symlinks is mapped as well and stays inside of the root.
+	// Only Setstat follows symlinks.
+	req := p.request(r)
+	for _, name := range []string{req.Filepath, req.Target} {
+		if name == "" {
+			continue
+		}
+		if err := p.check(name, true, r.Method == "Setstat"); err != nil {
+			p.fs.auditCmd(req, err)
+			return err
+		}
+	}
+	if r.Method == "Rename" && p.deniesBelow(req.Filepath) {
+		// Denied paths would be moved out of their pattern.
+		log.Debugf("SFTP: Policy denies renaming %s", req.Filepath)
+		p.fs.auditCmd(req, sftp.ErrSSHFxPermissionDenied)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return p.fs.Filecmd(req)
+}
+
+func (p *policyFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	req := p.request(r)
+	if err := p.check(req.Filepath, false, r.Method == "List" || r.Method == "Stat"); err != nil {
+		return nil, err
+	}
+	lister, err := p.fs.Filelist(req)
+	if err != nil || len(p.policy.Deny) == 0 && r.Method != "Readlink" {
+		return lister, err
+	}
+	list, ok := lister.(listerat)
+	if !ok {
+		return lister, nil
+	}
+	switch r.Method {
+	case "List":
+		// Denied files are hidden.
+		allowed := make(listerat, 0, len(list))
+		for _, file := range list {
+			if !p.denied(path.Join(req.Filepath, file.Name())) {
+				allowed = append(allowed, file)
+			}
+		}
+		return allowed, nil
+	case "Readlink":
+		if len(list) == 1 {
+			if link, ok := list[0].(linkTarget); ok {
+				link.target = p.clientPath(link.target)
+				return listerat([]os.FileInfo{link}), nil
+			}
+		}
+	}
+	return list, nil
+}
+
+// SftpChannel implements ssh2docksal.SftpExtensionHandler. The extensions are
+// restricted by the policy as well.
+func (p *policyFS) SftpChannel(channel io.ReadWriteCloser) io.ReadWriteCloser {
+	c := p.fs.SftpChannel(channel).(*extensionChannel)
+	c.policy = p
+	return c
+}
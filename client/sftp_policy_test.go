@@ -0,0 +1,151 @@
+package client
+
+import (
+	"github.com/andock/ssh2docksal"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// isPermissionDenied checks for the permission denied status of the sftp client.
+func isPermissionDenied(err error) bool {
+	status, ok := err.(*sftp.StatusError)
+	return ok && status.Code == ssh_FX_PERMISSION_DENIED
+}
+
+func TestPolicyFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "docroot/sites/default/files"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docroot/sites/default/settings.php"), []byte("<?php"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "docroot/sites/default/files/a.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "docroot/.env"), []byte("SECRET=1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644)
+
+	connect := func(policy ssh2docksal.SftpPolicy) (*sftp.Client, func()) {
+		fs := &root{
+			files:      make(map[string]*dockerFile),
+			config:     ssh2docksal.Config{SftpCacheTTL: time.Hour},
+			mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+			userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+		}
+		fs.dockerFile = newDockerFile("/", true, "")
+		fs.dockerFile.root = fs
+		p := newPolicyFS(fs, policy)
+		c1, c2 := netPipe(t)
+		server := sftp.NewRequestServer(p.SftpChannel(c1), sftp.Handlers{FileGet: p, FilePut: p, FileCmd: p, FileList: p})
+		go server.Serve()
+		client, err := sftp.NewClientPipe(c2, c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, func() {
+			client.Close()
+			server.Close()
+		}
+	}
+
+	client, done := connect(ssh2docksal.SftpPolicy{Root: "/var/www/docroot", Deny: []string{".env", "settings.php"}})
+	files, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "sites" {
+		t.Errorf("Expected the root of the policy without denied files, got %d files", len(files))
+	}
+	if _, err := client.Stat("/../secret.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected paths to stay inside of the root, got %v", err)
+	}
+	if _, err := client.Open("/.env"); !isPermissionDenied(err) {
+		t.Errorf("Expected denied files to be unreadable, got %v", err)
+	}
+	if err := client.Rename("/sites/default/files/a.txt", "/sites/default/settings.php"); !isPermissionDenied(err) {
+		t.Errorf("Expected renames to denied files to fail, got %v", err)
+	}
+	os.Symlink("../secret.txt", filepath.Join(dir, "docroot/leak"))
+	os.Symlink("sites/default", filepath.Join(dir, "docroot/default"))
+	if _, err := client.Open("/leak"); !isPermissionDenied(err) {
+		t.Errorf("Expected symlinks out of the root to be denied, got %v", err)
+	}
+	if _, err := client.Open("/default/settings.php"); !isPermissionDenied(err) {
+		t.Errorf("Expected symlinks to denied files to be denied, got %v", err)
+	}
+	if target, err := client.ReadLink("/leak"); err != nil || target != "../secret.txt" {
+		t.Errorf("Expected the symlink itself to be allowed, got %q %v", target, err)
+	}
+	os.MkdirAll(filepath.Join(dir, "docroot/swap"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "docroot/swap/secret.txt"), []byte("public"), 0644)
+	if _, err := client.Stat("/swap/secret.txt"); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "docroot/swap"))
+	os.Symlink("..", filepath.Join(dir, "docroot/swap"))
+	if _, err := client.Open("/swap/secret.txt"); !isPermissionDenied(err) {
+		t.Errorf("Expected folders replaced by symlinks out of the root to be denied, got %v", err)
+	}
+	file, err := client.Create("/sites/default/files/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("b"))
+	file.Close()
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "docroot/sites/default/files/b.txt")); string(content) != "b" {
+		t.Errorf("Expected the upload below the root, got %q", content)
+	}
+	if err := client.Symlink("/sites/default/files", "/files"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := client.ReadLink("/files"); err != nil || target != "/sites/default/files" {
+		t.Errorf("Expected the link target of the client, got %q %v", target, err)
+	}
+	if target, _ := os.Readlink(filepath.Join(dir, "docroot/files")); target != "/var/www/docroot/sites/default/files" {
+		t.Errorf("Expected the link target in the container, got %q", target)
+	}
+	done()
+
+	client, done = connect(ssh2docksal.SftpPolicy{ReadOnly: true})
+	defer done()
+	if _, err := client.Stat("/var/www/secret.txt"); err != nil {
+		t.Errorf("Read-only sessions should read, got %v", err)
+	}
+	if _, err := client.Create("/var/www/c.txt"); !isPermissionDenied(err) {
+		t.Errorf("Expected uploads to fail, got %v", err)
+	}
+	for name, err := range map[string]error{
+		"Remove": client.Remove("/var/www/secret.txt"),
+		"Mkdir":  client.Mkdir("/var/www/new"),
+		"Chmod":  client.Chmod("/var/www/secret.txt", 0600),
+	} {
+		if !isPermissionDenied(err) {
+			t.Errorf("Expected %s to fail, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "secret.txt")); err != nil {
+		t.Errorf("Expected the file to be unchanged, got %v", err)
+	}
+}
+
+func TestPolicyPaths(t *testing.T) {
+	p := newPolicyFS(&root{}, ssh2docksal.SftpPolicy{Root: "/var/www/docroot", Deny: []string{".git", "/var/www/docroot/sites/*/settings.php"}})
+	if name := p.containerPath("/../../etc/passwd"); name != "/var/www/docroot/etc/passwd" {
+		t.Errorf("Unexpected container path %s", name)
+	}
+	if name := p.clientPath("/var/www/docroot/core"); name != "/core" {
+		t.Errorf("Unexpected client path %s", name)
+	}
+	if name := p.jailedPath("/home/docker"); name != "/" {
+		t.Errorf("Expected paths outside of the root to become the root, got %s", name)
+	}
+	if !p.denied("/var/www/docroot/.git/config") || !p.denied("/var/www/docroot/sites/default/settings.php") || p.denied("/var/www/docroot/index.php") {
+		t.Errorf("Unexpected deny patterns result")
+	}
+	if !p.deniesBelow("/var/www/docroot/sites") || !p.deniesBelow("/var/www") || p.deniesBelow("/var/www/docroot/core") || p.deniesBelow("/var/www/docroot/sites/default/settings.php") {
+		t.Errorf("Expected renames of folders of denied paths to be denied")
+	}
+}
@@ -0,0 +1,192 @@
+package client
+
+// Prefetch of folder trees. IDEs sync a project by listing it folder by folder,
+// which costs an exec per folder. The metadata of the whole tree is fetched with
+// a single find instead and the following List and Stat requests are answered
+// from it until the cache TTL expires. Sessions with the agent or a host mount
+// list folders cheaply and don't prefetch.
+
+import (
+	"bytes"
+	"github.com/apex/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// walkLists is the number of folders listed below the first one which makes a walk.
+const walkLists = 3
+
+// maxPrefetchFiles is the maximum number of files of a prefetched tree.
+const maxPrefetchFiles = 200000
+
+// treeScript prints all files below the folder given as $1 with their path relative to it.
+// Busybox find has no -printf, these containers list folders one by one.
+const treeScript = `if ! find / -maxdepth 0 -printf '' 2>/dev/null; then
+	echo "find -printf is not supported" >&2
+	exit 1
+fi
+exec find -H "$1" -mindepth 1 -printf '` + treeFormat + `'`
+
+// treeFormat is statFormat with the relative path as name.
+const treeFormat = `%y\0%m\0%s\0%T@\0%U\0%G\0%l\0%P\0`
+
+// listing is a prefetched folder.
+type listing struct {
+	files   []os.FileInfo
+	names   map[string]*dockerFile
+	fetched time.Time
+}
+
+// prefetchRoot returns the folder whose tree is prefetched for a list of path or
+// an empty string. These are the configured prefetch folders and the first folder
+// of a walk.
+func (fs *root) prefetchRoot(path string) string {
+	for _, folder := range fs.config.SftpPrefetch {
+		folder = filepath.Clean(folder)
+		if path == folder || strings.HasPrefix(path, strings.TrimSuffix(folder, "/")+"/") {
+			return folder
+		}
+	}
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	if fs.walkRoot != "" && fs.walkRoot != "/" && strings.HasPrefix(path, fs.walkRoot+"/") {
+		fs.walkLists++
+	} else {
+		fs.walkRoot, fs.walkLists = path, 0
+	}
+	if fs.walkLists >= walkLists && fs.walkRoot != "/" {
+		return fs.walkRoot
+	}
+	return ""
+}
+
+// prefetch fetches the tree of the prefetch root of path unless the listing of
+// path is known already.
+func (fs *root) prefetch(path string) {
+	if fs.config.SftpCacheTTL == 0 || fs.prefetchedList(path) != nil {
+		return
+	}
+	folder := fs.prefetchRoot(path)
+	if folder == "" {
+		return
+	}
+	files, err := fs.execTree(folder)
+	if err != nil {
+		log.Debugf("SFTP: Unable to prefetch %s: %s", folder, err.Error())
+		return
+	}
+	fs.storeTree(folder, files)
+}
+
+// execTree returns the metadata of all files below folder.
+func (fs *root) execTree(folder string) ([]*dockerFile, error) {
+	stream, err := streamExecCmd(fs.containerID, []string{"sh", "-c", treeScript, "sh", folder}, fs.config.DockerUser)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	output, err := readTree(stream)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatOutput(output, folder, fs.containerID)
+}
+
+// readTree reads the output of treeScript. Reading stops with os.ErrInvalid as
+// soon as the tree has more than maxPrefetchFiles files.
+func readTree(r io.Reader) (string, error) {
+	var output bytes.Buffer
+	buf := make([]byte, 32*1024)
+	fields := 0
+	for {
+		n, err := r.Read(buf)
+		fields += bytes.Count(buf[:n], []byte{0})
+		if fields > maxPrefetchFiles*statFields {
+			return "", os.ErrInvalid
+		}
+		output.Write(buf[:n])
+		if err == io.EOF {
+			return output.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// storeTree stores the listings of folder and all folders below it.
+func (fs *root) storeTree(folder string, files []*dockerFile) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	if fs.listings == nil {
+		fs.listings = make(map[string]*listing)
+	}
+	now := time.Now()
+	listings := map[string]*listing{folder: {names: make(map[string]*dockerFile), fetched: now}}
+	for _, file := range files {
+		if file.isdir {
+			listings[file.name] = &listing{names: make(map[string]*dockerFile), fetched: now}
+		}
+	}
+	for _, file := range files {
+		file.root = fs
+		if parent, ok := listings[filepath.Dir(file.name)]; ok {
+			parent.files = append(parent.files, file)
+			parent.names[file.name] = file
+		}
+	}
+	for name, l := range listings {
+		fs.listings[name] = l
+	}
+}
+
+// prefetchedList returns the prefetched files of folder or nil.
+func (fs *root) prefetchedList(folder string) []os.FileInfo {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	if l := fs.freshListing(folder); l != nil {
+		if l.files == nil {
+			return []os.FileInfo{}
+		}
+		return l.files
+	}
+	return nil
+}
+
+// prefetched returns the prefetched file of path. ok is false if the folder of
+// path is not prefetched, file is nil if the file does not exist.
+func (fs *root) prefetched(path string) (file *dockerFile, ok bool) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	if l := fs.freshListing(filepath.Dir(path)); l != nil {
+		return l.names[path], true
+	}
+	return nil, false
+}
+
+// freshListing returns the listing of folder if it did not expire. The caller holds filesLock.
+func (fs *root) freshListing(folder string) *listing {
+	l, ok := fs.listings[folder]
+	if !ok {
+		return nil
+	}
+	if time.Since(l.fetched) >= fs.config.SftpCacheTTL {
+		delete(fs.listings, folder)
+		return nil
+	}
+	return l
+}
+
+// forgetListingsLocked drops the listings of path, the folders below it and its folder.
+func (fs *root) forgetListingsLocked(path string) {
+	delete(fs.listings, filepath.Dir(path))
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for name := range fs.listings {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(fs.listings, name)
+		}
+	}
+}
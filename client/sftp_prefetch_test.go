@@ -0,0 +1,123 @@
+package client
+
+import (
+	"github.com/andock/ssh2docksal"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTreeScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "core/lib"), 0755)
+	os.MkdirAll(filepath.Join(dir, "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "index.php"), []byte("<?php"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "core/lib/a b.php"), []byte("<?php"), 0644)
+	os.Symlink("core", filepath.Join(dir, "link"))
+
+	output, err := exec.Command("sh", "-c", treeScript, "sh", dir).Output()
+	if err != nil {
+		t.Skipf("No GNU find: %s", err)
+	}
+	files, err := parseStatOutput(string(output), "/var/www", "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &root{files: make(map[string]*dockerFile), config: ssh2docksal.Config{SftpCacheTTL: time.Minute}}
+	fs.expireChanges()
+	fs.storeTree("/var/www", files)
+
+	if list := fs.prefetchedList("/var/www"); len(list) != 4 {
+		t.Errorf("Expected 4 files in the root, got %d", len(list))
+	}
+	if list := fs.prefetchedList("/var/www/empty"); list == nil || len(list) != 0 {
+		t.Errorf("Expected an empty listing, got %v", list)
+	}
+	if list := fs.prefetchedList("/var/www/link"); list != nil {
+		t.Errorf("Symlinked folders should not be prefetched")
+	}
+	if file, ok := fs.prefetched("/var/www/core/lib/a b.php"); !ok || file == nil || file.Size() != 5 {
+		t.Errorf("Expected the prefetched file, got %v %v", file, ok)
+	}
+	if file, ok := fs.prefetched("/var/www/core/missing.php"); !ok || file != nil {
+		t.Errorf("Expected missing files of prefetched folders to not exist")
+	}
+	if file, err := fs.fetch("/var/www/core/missing.php"); !os.IsNotExist(err) {
+		t.Errorf("Expected os.ErrNotExist without an exec, got %v %v", file, err)
+	}
+
+	fs.changed("/var/www/core/lib/a b.php")
+	if list := fs.prefetchedList("/var/www/core/lib"); list != nil {
+		t.Errorf("Expected changes to drop the listing of the folder")
+	}
+	if list := fs.prefetchedList("/var/www/core"); list == nil {
+		t.Errorf("Expected other listings to be kept")
+	}
+	fs.forget("/var/www/core")
+	if _, ok := fs.prefetched("/var/www/core/lib/a b.php"); ok {
+		t.Errorf("Expected forget to drop the listings below the path")
+	}
+
+	fs.config.SftpCacheTTL = time.Nanosecond
+	if list := fs.prefetchedList("/var/www"); list != nil {
+		t.Errorf("Expected listings to expire with the cache TTL")
+	}
+}
+
+// endlessTree is a tree script output which never ends.
+type endlessTree struct{}
+
+func (endlessTree) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestReadTree(t *testing.T) {
+	output, err := readTree(strings.NewReader("f\x00644\x005\x00"))
+	if err != nil || output != "f\x00644\x005\x00" {
+		t.Errorf("Expected the whole output, got %q %v", output, err)
+	}
+	if _, err := readTree(endlessTree{}); err != os.ErrInvalid {
+		t.Errorf("Expected reading to stop after maxPrefetchFiles, got %v", err)
+	}
+}
+
+func TestPrefetchRoot(t *testing.T) {
+	fs := &root{config: ssh2docksal.Config{SftpPrefetch: []string{"/var/www/"}}}
+	if folder := fs.prefetchRoot("/var/www/docroot"); folder != "/var/www" {
+		t.Errorf("Expected the configured folder, got %q", folder)
+	}
+	if folder := fs.prefetchRoot("/var/wwwdata"); folder != "" {
+		t.Errorf("Expected no prefetch outside of the configured folder, got %q", folder)
+	}
+
+	fs = &root{}
+	walk := []string{"/home/docker/project", "/home/docker/project/a", "/home/docker/project/b", "/home/docker/project/a/c"}
+	for i, path := range walk {
+		folder := fs.prefetchRoot(path)
+		if i < walkLists && folder != "" {
+			t.Errorf("Unexpected prefetch of %q after %d folders", folder, i)
+		}
+		if i == walkLists && folder != "/home/docker/project" {
+			t.Errorf("Expected the walk to prefetch the first folder, got %q", folder)
+		}
+	}
+	if folder := fs.prefetchRoot("/etc"); folder != "" {
+		t.Errorf("Expected a new walk, got %q", folder)
+	}
+	for _, path := range []string{"/", "/etc", "/usr", "/var"} {
+		if folder := fs.prefetchRoot(path); folder != "" {
+			t.Errorf("The root folder should never be prefetched, got %q", folder)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package client
+
+// Upload limits of sftp sessions. Writes fail with EFBIG beyond
+// Config.SftpMaxFileSize, with EDQUOT beyond the session or the daily quota
+// and with ENOSPC if they would leave less than Config.SftpMinFreeSpace on the
+// file system. The request server sends them as failure status with the error
+// as message, e.g. "write /var/www/dump.sql: disk quota exceeded".
+
+import (
+	"github.com/apex/log"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// freeSpaceTTL is how long the free space of a file system is trusted.
+const freeSpaceTTL = 5 * time.Second
+
+// dailyUsage counts the bytes written per quota key and day across sessions.
+var dailyUsage = struct {
+	sync.Mutex
+	day   string
+	bytes map[string]int64
+}{bytes: make(map[string]int64)}
+
+// uploadQuota tracks the writes of a session.
+type uploadQuota struct {
+	lock    sync.Mutex
+	written int64
+	// free holds the free space per file system minus the bytes written since it was checked.
+	free map[string]*freeSpace
+}
+
+type freeSpace struct {
+	// bytes is -1 until the first check succeeded.
+	bytes   int64
+	checked time.Time
+}
+
+// checkWrite accounts a write of n bytes at off to the file. Returns a path
+// error if the write exceeds a limit. Files without root are not limited.
+func (file *dockerFile) checkWrite(off int64, n int) error {
+	fs := file.root
+	if fs == nil || !fs.config.SftpLimited() {
+		return nil
+	}
+	limits := &fs.config
+	size := int64(n)
+	if limits.SftpMaxFileSize > 0 && off+size > limits.SftpMaxFileSize {
+		log.Warnf("SFTP: %s exceeds the maximum file size", file.name)
+		return &os.PathError{Op: "write", Path: file.name, Err: syscall.EFBIG}
+	}
+	if size == 0 {
+		return nil
+	}
+	key := fs.fileSystemKey(file.name)
+	if limits.SftpMinFreeSpace > 0 {
+		fs.refreshFreeSpace(key, path.Dir(file.name))
+	}
+	fs.quota.lock.Lock()
+	defer fs.quota.lock.Unlock()
+	if limits.SftpSessionQuota > 0 && fs.quota.written+size > limits.SftpSessionQuota {
+		log.Warnf("SFTP: Upload of %s exceeds the session quota", file.name)
+		return &os.PathError{Op: "write", Path: file.name, Err: syscall.EDQUOT}
+	}
+	space := fs.quota.free[key]
+	if limits.SftpMinFreeSpace > 0 && space != nil && space.bytes >= 0 && space.bytes-size < limits.SftpMinFreeSpace {
+		log.Warnf("SFTP: Upload of %s exceeds the free space", file.name)
+		return &os.PathError{Op: "write", Path: file.name, Err: syscall.ENOSPC}
+	}
+	if !chargeDailyQuota(limits.DailyQuotaKey(), size, limits.SftpDailyQuota) {
+		log.Warnf("SFTP: Upload of %s exceeds the daily quota of %s", file.name, limits.DailyQuotaKey())
+		return &os.PathError{Op: "write", Path: file.name, Err: syscall.EDQUOT}
+	}
+	fs.quota.written += size
+	if space != nil && space.bytes >= 0 {
+		space.bytes -= size
+	}
+	return nil
+}
+
+// checkQuota fails with EDQUOT if the session can't write anymore, so new
+// uploads fail on open.
+func (fs *root) checkQuota(name string) error {
+	limits := &fs.config
+	fs.quota.lock.Lock()
+	exceeded := limits.SftpSessionQuota > 0 && fs.quota.written >= limits.SftpSessionQuota
+	fs.quota.lock.Unlock()
+	if limits.SftpDailyQuota > 0 {
+		dailyUsage.Lock()
+		exceeded = exceeded || dailyUsedLocked(limits.DailyQuotaKey()) >= limits.SftpDailyQuota
+		dailyUsage.Unlock()
+	}
+	if exceeded {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.EDQUOT}
+	}
+	return nil
+}
+
+// chargeDailyQuota adds size bytes to the daily usage of key if they fit into
+// quota. A quota of 0 is unlimited.
+func chargeDailyQuota(key string, size int64, quota int64) bool {
+	if quota <= 0 {
+		return true
+	}
+	dailyUsage.Lock()
+	defer dailyUsage.Unlock()
+	if dailyUsedLocked(key)+size > quota {
+		return false
+	}
+	dailyUsage.bytes[key] += size
+	return true
+}
+
+// dailyUsedLocked returns the bytes written today by key. The caller holds the lock of dailyUsage.
+func dailyUsedLocked(key string) int64 {
+	if day := time.Now().Format("2006-01-02"); day != dailyUsage.day {
+		dailyUsage.day = day
+		dailyUsage.bytes = make(map[string]int64)
+	}
+	return dailyUsage.bytes[key]
+}
+
+// fileSystemKey returns the host mount of name or "" for the file system of the container.
+func (fs *root) fileSystemKey(name string) string {
+	if m, _ := fs.mountOf(name); m != nil {
+		return m.containerPath
+	}
+	return ""
+}
+
+// refreshFreeSpace checks the free space of the file system of folder if the
+// last check is older than freeSpaceTTL. Failed checks don't limit uploads.
+func (fs *root) refreshFreeSpace(key string, folder string) {
+	fs.quota.lock.Lock()
+	if fs.quota.free == nil {
+		fs.quota.free = make(map[string]*freeSpace)
+	}
+	space := fs.quota.free[key]
+	if space == nil {
+		space = &freeSpace{bytes: -1}
+		fs.quota.free[key] = space
+	} else if time.Since(space.checked) < freeSpaceTTL {
+		fs.quota.lock.Unlock()
+		return
+	}
+	// Concurrent writes don't check again while the check runs.
+	space.checked = time.Now()
+	fs.quota.lock.Unlock()
+
+	info, err := fs.execStatFS(folder)
+	if err != nil {
+		log.Debugf("SFTP: Unable to check the free space of %s: %s", folder, err.Error())
+		return
+	}
+	blockSize := info.FragmentSize
+	if blockSize == 0 {
+		blockSize = info.BlockSize
+	}
+	fs.quota.lock.Lock()
+	space.bytes = int64(info.BlocksAvail * blockSize)
+	fs.quota.lock.Unlock()
+}
+
+// limitedFile applies the upload limits to the writes of a host file.
+type limitedFile struct {
+	*os.File
+	file *dockerFile
+}
+
+func (f *limitedFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.file.checkWrite(off, len(p)); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"github.com/andock/ssh2docksal"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// limitError returns the errno of a failed upload limit check.
+func limitError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+func TestCheckWrite(t *testing.T) {
+	fs := &root{config: ssh2docksal.Config{SftpMaxFileSize: 10, SftpSessionQuota: 15, SessionKey: "SHA256:session"}}
+	file := newDockerFile("/var/www/a.txt", false, "container")
+	file.root = fs
+	if err := file.checkWrite(5, 6); limitError(err) != syscall.EFBIG {
+		t.Errorf("Expected EFBIG beyond the maximum file size, got %v", err)
+	}
+	if err := file.checkWrite(0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.checkWrite(0, 6); limitError(err) != syscall.EDQUOT {
+		t.Errorf("Expected EDQUOT beyond the session quota, got %v", err)
+	}
+	if err := fs.checkQuota(file.name); err != nil {
+		t.Errorf("Expected the session to open uploads with quota left, got %v", err)
+	}
+	file.checkWrite(0, 5)
+	if err := fs.checkQuota(file.name); limitError(err) != syscall.EDQUOT {
+		t.Errorf("Expected opens to fail with the quota used up, got %v", err)
+	}
+	if err := newDockerFile("/a.txt", false, "container").checkWrite(0, 100); err != nil {
+		t.Errorf("Files without root should not be limited, got %v", err)
+	}
+
+	// The daily quota is shared by the sessions of the key.
+	config := ssh2docksal.Config{SftpDailyQuota: 10, SessionKey: "SHA256:daily"}
+	for i, expected := range []error{nil, syscall.EDQUOT} {
+		file := newDockerFile("/var/www/a.txt", false, "container")
+		file.root = &root{config: config}
+		if err := file.checkWrite(0, 6); limitError(err) != expected {
+			t.Errorf("Unexpected result %v of session %d", err, i)
+		}
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	connect := func(config ssh2docksal.Config) (*sftp.Client, func()) {
+		fs := &root{
+			files:      make(map[string]*dockerFile),
+			mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+			userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+			config: config,
+		}
+		fs.dockerFile = newDockerFile("/", true, "")
+		fs.dockerFile.root = fs
+		c1, c2 := netPipe(t)
+		server := sftp.NewRequestServer(fs.SftpChannel(c1), sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+		go server.Serve()
+		client, err := sftp.NewClientPipe(c2, c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, func() {
+			client.Close()
+			server.Close()
+		}
+	}
+	upload := func(client *sftp.Client, name string, size int) error {
+		file, err := client.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(make([]byte, size))
+		file.Close()
+		return err
+	}
+
+	client, done := connect(ssh2docksal.Config{SftpMaxFileSize: 1 << 10})
+	err = upload(client, "/var/www/big.bin", 2<<10)
+	if status, ok := err.(*sftp.StatusError); !ok || status.Code != fxFailure || !strings.Contains(err.Error(), "file too large") {
+		t.Errorf("Expected a failure status for files beyond the maximum size, got %v", err)
+	}
+	if err := upload(client, "/var/www/small.bin", 1<<10); err != nil {
+		t.Errorf("Expected files up to the maximum size to upload, got %v", err)
+	}
+	if err := client.Truncate("/var/www/small.bin", 4<<10); err == nil {
+		t.Errorf("Expected truncates beyond the maximum size to fail")
+	}
+	done()
+
+	client, done = connect(ssh2docksal.Config{SftpMinFreeSpace: 1 << 62})
+	err = upload(client, "/var/www/full.bin", 10)
+	if err == nil || !strings.Contains(err.Error(), "no space left on device") {
+		t.Errorf("Expected uploads to fail without free space, got %v", err)
+	}
+	done()
+
+	client, done = connect(ssh2docksal.Config{SftpSessionQuota: 100})
+	defer done()
+	if err := upload(client, "/var/www/a.bin", 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Create("/var/www/b.bin"); err == nil || !strings.Contains(err.Error(), "disk quota exceeded") {
+		t.Errorf("Expected opens to fail with the quota used up, got %v", err)
+	}
+	if stat, err := os.Stat(filepath.Join(dir, "a.bin")); err != nil || stat.Size() != 100 {
+		t.Errorf("Expected the upload within the quota, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+// Applies the attributes of sftp Setstat requests.
+
+import (
+	"github.com/andock/ssh2docksal/agent"
+	"github.com/pkg/sftp"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// fileAttrs are the attributes of a Setstat request. Only the attributes in flags are changed.
+type fileAttrs struct {
+	flags sftp.FileAttrFlags
+	size  uint64
+	mode  os.FileMode
+	uid   uint32
+	gid   uint32
+	atime time.Time
+	mtime time.Time
+}
+
+func newFileAttrs(r *sftp.Request) *fileAttrs {
+	stat := r.Attributes()
+	return &fileAttrs{
+		flags: r.AttrFlags(),
+		size:  stat.Size,
+		mode:  unixPermToFileMode(stat.Mode & 07777),
+		uid:   stat.UID,
+		gid:   stat.GID,
+		atime: time.Unix(int64(stat.Atime), 0),
+		mtime: time.Unix(int64(stat.Mtime), 0),
+	}
+}
+
+// execSetstat applies all attributes of a Setstat request. The owner is changed
+// first as chown clears the setuid bit, the times last as truncate changes the mtime.
+func (file *dockerFile) execSetstat(attrs *fileAttrs) error {
+	if ref := file.root.hostFile(file.name); ref != nil {
+		defer ref.Close()
+		if ref.m.readOnly {
+			return os.ErrPermission
+		}
+		return file.setstatDone(attrs, ref.object(func(path string) error {
+			if err := file.root.restrictHostAttrs(path, attrs); err != nil {
+				return err
+			}
+			return setHostAttrs(path, attrs)
+		}))
+	}
+	if a := file.root.agent(); a != nil {
+		err := setAgentAttrs(a, file.name, attrs)
+		if err != errAgentUnavailable {
+			return file.setstatDone(attrs, err)
+		}
+	}
+	return file.setstatDone(attrs, setExecAttrs(file.containerID, file.root.config.DockerUser, file.name, attrs))
+}
+
+// restrictAttrs applies the ownership rules of the kernel for unprivileged
+// users to attrs of a file owned by uid and gid. Uploads are extracted and
+// host files changed as root, so these rules are not enforced otherwise:
+// only root changes the owner, setuid and setgid are kept for files of the
+// exec user only.
+func (fs *root) restrictAttrs(attrs *fileAttrs, uid int, gid int) error {
+	if execUID, _ := fs.execUser(); execUID == 0 {
+		return nil
+	}
+	if attrs.flags.UidGid && (int(attrs.uid) != uid || int(attrs.gid) != gid) {
+		return os.ErrPermission
+	}
+	if attrs.flags.Permissions && !fs.keepsSetID(uid) {
+		attrs.mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	return nil
+}
+
+// restrictHostAttrs applies the rules of the exec user to attrs of a host file,
+// which ssh2docksal changes with its own permissions if it can't switch to the
+// exec user: besides restrictAttrs only the owner changes the permissions and
+// sets the times.
+func (fs *root) restrictHostAttrs(hostPath string, attrs *fileAttrs) error {
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+	uid, gid := -1, -1
+	if sys, ok := fi.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(sys.Uid), int(sys.Gid)
+	}
+	if execUID, _ := fs.execUser(); execUID != 0 && uid != execUID && (attrs.flags.Permissions || attrs.flags.Acmodtime) {
+		return os.ErrPermission
+	}
+	return fs.restrictAttrs(attrs, uid, gid)
+}
+
+// keepsSetID checks if files owned by uid keep setuid and setgid when the exec user changes them.
+func (fs *root) keepsSetID(uid int) bool {
+	execUID, _ := fs.execUser()
+	return execUID == 0 || execUID >= 0 && uid == execUID
+}
+
+// setstatDone updates the cached attributes after a successful Setstat.
+func (file *dockerFile) setstatDone(attrs *fileAttrs, err error) error {
+	if err != nil {
+		return err
+	}
+	if attrs.flags.UidGid {
+		file.uid, file.gid = attrs.uid, attrs.gid
+	}
+	if attrs.flags.Permissions && file.hasStat {
+		file.mode = file.mode&os.ModeType | attrs.mode
+	}
+	if attrs.flags.Size {
+		file.size = int64(attrs.size)
+	}
+	if attrs.flags.Acmodtime {
+		file.modtime = attrs.mtime
+	}
+	return nil
+}
+
+func setHostAttrs(hostPath string, attrs *fileAttrs) error {
+	if attrs.flags.UidGid {
+		if err := os.Chown(hostPath, int(attrs.uid), int(attrs.gid)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags.Permissions {
+		if err := os.Chmod(hostPath, attrs.mode); err != nil {
+			return err
+		}
+	}
+	if attrs.flags.Size {
+		if err := os.Truncate(hostPath, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags.Acmodtime {
+		return os.Chtimes(hostPath, attrs.atime, attrs.mtime)
+	}
+	return nil
+}
+
+// setAgentAttrs returns errAgentUnavailable if the agent died.
+func setAgentAttrs(a *agentClient, path string, attrs *fileAttrs) error {
+	requests := []*agent.Request{}
+	if attrs.flags.UidGid {
+		requests = append(requests, &agent.Request{Op: agent.OpChown, Path: path, UID: attrs.uid, GID: attrs.gid})
+	}
+	if attrs.flags.Permissions {
+		requests = append(requests, &agent.Request{Op: agent.OpChmod, Path: path, Mode: uint32(attrs.mode)})
+	}
+	if attrs.flags.Size {
+		requests = append(requests, &agent.Request{Op: agent.OpTruncate, Path: path, Length: int64(attrs.size)})
+	}
+	if attrs.flags.Acmodtime {
+		requests = append(requests, &agent.Request{Op: agent.OpChtimes, Path: path, Atime: attrs.atime.UnixNano(), Mtime: attrs.mtime.UnixNano()})
+	}
+	for _, req := range requests {
+		if _, err := a.call(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setExecAttrs(containerID string, dockerUser string, path string, attrs *fileAttrs) error {
+	commands := [][]string{}
+	if attrs.flags.UidGid {
+		owner := strconv.FormatUint(uint64(attrs.uid), 10) + ":" + strconv.FormatUint(uint64(attrs.gid), 10)
+		commands = append(commands, []string{"chown", owner, "--", path})
+	}
+	if attrs.flags.Permissions {
+		commands = append(commands, []string{"chmod", strconv.FormatUint(uint64(unixMode(attrs.mode)), 8), "--", path})
+	}
+	if attrs.flags.Size {
+		commands = append(commands, []string{"truncate", "-s", strconv.FormatUint(attrs.size, 10), "--", path})
+	}
+	if attrs.flags.Acmodtime {
+		commands = append(commands,
+			[]string{"touch", "-c", "-a", "-d", "@" + strconv.FormatInt(attrs.atime.Unix(), 10), "--", path},
+			[]string{"touch", "-c", "-m", "-d", "@" + strconv.FormatInt(attrs.mtime.Unix(), 10), "--", path})
+	}
+	for _, cmd := range commands {
+		if err := simpleExec(containerID, cmd, dockerUser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
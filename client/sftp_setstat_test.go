@@ -0,0 +1,168 @@
+package client
+
+import (
+	"errors"
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetHostAttrs(t *testing.T) {
+	file, err := ioutil.TempFile("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("0123456789")
+	file.Close()
+
+	mtime := time.Unix(1500000000, 0)
+	attrs := &fileAttrs{
+		flags: sftp.FileAttrFlags{Size: true, Permissions: true, Acmodtime: true},
+		size:  4,
+		mode:  0600 | os.ModeSetgid,
+		atime: mtime,
+		mtime: mtime,
+	}
+	if err := setHostAttrs(file.Name(), attrs); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != 4 {
+		t.Errorf("Expected size 4, got %d", stat.Size())
+	}
+	if stat.Mode() != 0600|os.ModeSetgid {
+		t.Errorf("Expected mode %s, got %s", 0600|os.ModeSetgid, stat.Mode())
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Errorf("Expected mtime %s, got %s", mtime, stat.ModTime())
+	}
+
+	// Only the flagged attributes change.
+	if err := setHostAttrs(file.Name(), &fileAttrs{flags: sftp.FileAttrFlags{Size: true}, size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = os.Stat(file.Name())
+	if stat.Size() != 2 || stat.Mode() != 0600|os.ModeSetgid {
+		t.Errorf("Unexpected size %d or mode %s", stat.Size(), stat.Mode())
+	}
+}
+
+func TestSftpError(t *testing.T) {
+	other := errors.New("disk on fire")
+	tests := []struct {
+		err      error
+		expected error
+	}{
+		{err: nil, expected: nil},
+		{err: os.ErrNotExist, expected: sftp.ErrSSHFxNoSuchFile},
+		{err: os.ErrPermission, expected: sftp.ErrSSHFxPermissionDenied},
+		{err: errors.New("chown: changing ownership of '/var/www/a': Operation not permitted"), expected: sftp.ErrSSHFxPermissionDenied},
+		{err: errors.New("touch: cannot touch '/etc/a': Permission denied"), expected: sftp.ErrSSHFxPermissionDenied},
+		{err: errors.New("chmod: cannot access '/var/www/a': No such file or directory"), expected: sftp.ErrSSHFxNoSuchFile},
+		{err: other, expected: other},
+	}
+	for _, test := range tests {
+		if err := sftpError(test.err); err != test.expected {
+			t.Errorf("sftpError(%v): expected %v, got %v", test.err, test.expected, err)
+		}
+	}
+}
+
+func TestRestrictAttrs(t *testing.T) {
+	fs := &root{userLoaded: true, uid: 1000, gid: 1000}
+	chown := &fileAttrs{flags: sftp.FileAttrFlags{UidGid: true}}
+	if err := fs.restrictAttrs(chown, 1000, 1000); err != os.ErrPermission {
+		t.Errorf("Expected owner changes to fail for other users than root, got %v", err)
+	}
+	chown.uid, chown.gid = 1000, 1000
+	if err := fs.restrictAttrs(chown, 1000, 1000); err != nil {
+		t.Errorf("Expected the current owner to be accepted, got %v", err)
+	}
+	chmod := &fileAttrs{flags: sftp.FileAttrFlags{Permissions: true}, mode: 0755 | os.ModeSetuid | os.ModeSetgid}
+	fs.restrictAttrs(chmod, 1000, 1000)
+	if chmod.mode != 0755|os.ModeSetuid|os.ModeSetgid {
+		t.Errorf("Expected files of the exec user to keep setuid, got %s", chmod.mode)
+	}
+	fs.restrictAttrs(chmod, 0, 0)
+	if chmod.mode != 0755 {
+		t.Errorf("Expected setuid and setgid to be dropped for files of other users, got %s", chmod.mode)
+	}
+
+	fs.uid, fs.gid = 0, 0
+	chown.uid = 0
+	chmod.mode |= os.ModeSetuid
+	if err := fs.restrictAttrs(chown, 1000, 1000); err != nil || fs.restrictAttrs(chmod, 1000, 1000) != nil || chmod.mode != 0755|os.ModeSetuid {
+		t.Errorf("Expected root to change owner and mode, got %v %s", err, chmod.mode)
+	}
+}
+
+func TestSpoolSetstat(t *testing.T) {
+	w := newTestSpool(t, "/var/www/shell", "#!/bin/sh")
+	defer w.discard()
+	w.file.root.uid, w.file.root.gid = 1000, 1000
+	w.uid, w.gid = 1000, 1000
+	if err := w.setstat(&fileAttrs{flags: sftp.FileAttrFlags{UidGid: true}}); err != os.ErrPermission {
+		t.Errorf("Expected the upload not to be given to root, got %v", err)
+	}
+	w.setstat(&fileAttrs{flags: sftp.FileAttrFlags{Permissions: true}, mode: 0755 | os.ModeSetuid})
+	upload, err := w.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.header.Uid != 1000 || upload.header.Mode != 04755 {
+		t.Errorf("Expected a setuid file of the exec user, got %d %o", upload.header.Uid, upload.header.Mode)
+	}
+
+	// Uploads to files of other users lose setuid like writes by non-owners.
+	w.uid, w.gid = 0, 0
+	if upload, _ := w.prepare(); upload.header.Uid != 0 || upload.header.Mode != 0755 {
+		t.Errorf("Expected setuid to be dropped, got %d %o", upload.header.Uid, upload.header.Mode)
+	}
+}
+
+func TestHostSetstatOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Changing the owner needs root")
+	}
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "root.sh"), []byte("#!/bin/sh"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "user.sh"), []byte("#!/bin/sh"), 0644)
+	os.Chown(filepath.Join(dir, "user.sh"), 1000, 1000)
+	os.Chmod(dir, 0755)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: 1000, gid: 1000,
+	}
+	file := func(name string) *dockerFile {
+		file := newDockerFile(name, false, "")
+		file.root = fs
+		return file
+	}
+
+	chown := &fileAttrs{flags: sftp.FileAttrFlags{UidGid: true}, uid: 0, gid: 0}
+	if err := file("/var/www/user.sh").execSetstat(chown); err != os.ErrPermission {
+		t.Errorf("Expected files not to be given to root, got %v", err)
+	}
+	chmod := &fileAttrs{flags: sftp.FileAttrFlags{Permissions: true}, mode: 0755 | os.ModeSetuid}
+	if err := file("/var/www/root.sh").execSetstat(chmod); err != os.ErrPermission {
+		t.Errorf("Expected files of other users to keep their mode, got %v", err)
+	}
+	if err := file("/var/www/user.sh").execSetstat(chmod); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(filepath.Join(dir, "user.sh")); stat.Mode() != 0755|os.ModeSetuid {
+		t.Errorf("Expected the exec user to change its files, got %s", stat.Mode())
+	}
+}
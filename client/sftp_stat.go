@@ -0,0 +1,195 @@
+package client
+
+// File metadata of the container in a NUL delimited machine format.
+// Each file is printed as 8 NUL terminated fields:
+// type (find %y), permissions (octal), size, mtime (unix, optional fraction), uid, gid, link target, name.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statFields is the number of fields printed per file.
+const statFields = 8
+
+// statFormat is the find -printf format of a file.
+const statFormat = `%y\0%m\0%s\0%T@\0%U\0%G\0%l\0%f\0`
+
+// statFallback prints the same format with stat -c for containers without GNU find (e.g. busybox).
+// $follow holds the symlink option of stat.
+const statFallback = `
+stat_file() {
+	set -- $(stat $follow -c '%f %s %Y %u %g' "$1") "$1"
+	m=$((0x$1))
+	case $((m & 61440)) in
+		16384) t=d ;;
+		40960) t=l ;;
+		8192) t=c ;;
+		24576) t=b ;;
+		4096) t=p ;;
+		49152) t=s ;;
+		*) t=f ;;
+	esac
+	l=""
+	[ "$t" = l ] && l=$(readlink "$6")
+	printf '%s\0%o\0%s\0%s\0%s\0%s\0%s\0%s\0' "$t" $((m & 4095)) "$2" "$3" "$4" "$5" "$l" "${6##*/}"
+}
+`
+
+// statScript prints the file given as $1. Symlinks are not followed (lstat).
+const statScript = `if ! [ -e "$1" ] && ! [ -L "$1" ]; then exit 0; fi
+if find / -maxdepth 0 -printf '' 2>/dev/null; then
+	exec find "$1" -maxdepth 0 -printf '` + statFormat + `'
+fi
+follow=` + statFallback + `stat_file "$1"`
+
+// statFollowScript prints the file given as $1 following symlinks (stat).
+// Dangling symlinks do not exist.
+const statFollowScript = `if ! [ -e "$1" ]; then exit 0; fi
+if find / -maxdepth 0 -printf '' 2>/dev/null; then
+	exec find -L "$1" -maxdepth 0 -printf '` + statFormat + `'
+fi
+follow=-L` + statFallback + `stat_file "$1"`
+
+// listScript prints all files of the folder given as $1. A symlinked folder is listed.
+const listScript = `if find / -maxdepth 0 -printf '' 2>/dev/null; then
+	exec find -H "$1" -mindepth 1 -maxdepth 1 -printf '` + statFormat + `'
+fi
+follow=` + statFallback + `for f in "$1"/* "$1"/.[!.]* "$1"/..?*; do
+	if [ -e "$f" ] || [ -L "$f" ]; then stat_file "$f"; fi
+done`
+
+// fileModeTypes maps the find %y type to the os.FileMode type bits.
+var fileModeTypes = map[string]os.FileMode{
+	"f": 0,
+	"d": os.ModeDir,
+	"l": os.ModeSymlink,
+	"c": os.ModeDevice | os.ModeCharDevice,
+	"b": os.ModeDevice,
+	"p": os.ModeNamedPipe,
+	"s": os.ModeSocket,
+}
+
+// parseStatOutput parses the output of statScript or listScript. Names are joined with folder.
+func parseStatOutput(output string, folder string, containerID string) ([]*dockerFile, error) {
+	if output == "" {
+		return nil, nil
+	}
+	fields := strings.Split(strings.TrimSuffix(output, "\x00"), "\x00")
+	if len(fields)%statFields != 0 {
+		return nil, fmt.Errorf("Invalid stat output: %q", output)
+	}
+	files := make([]*dockerFile, 0, len(fields)/statFields)
+	for i := 0; i < len(fields); i += statFields {
+		file, err := parseStatFields(fields[i:i+statFields], folder, containerID)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func parseStatFields(fields []string, folder string, containerID string) (*dockerFile, error) {
+	fileType, ok := fileModeTypes[fields[0]]
+	if !ok {
+		return nil, fmt.Errorf("Invalid file type %q", fields[0])
+	}
+	perm, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid permissions %q", fields[1])
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid size %q", fields[2])
+	}
+	mtime, err := parseUnixTime(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(fields[4], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid uid %q", fields[4])
+	}
+	gid, err := strconv.ParseUint(fields[5], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gid %q", fields[5])
+	}
+
+	file := newDockerFile(filepath.Join(folder, fields[7]), fileType == os.ModeDir, containerID)
+	file.mode = fileType | unixPermToFileMode(uint32(perm))
+	file.size = size
+	file.modtime = mtime
+	file.uid = uint32(uid)
+	file.gid = uint32(gid)
+	file.symlink = fields[6]
+	file.hasStat = true
+	return file, nil
+}
+
+// unixPermToFileMode converts unix permission bits including setuid, setgid and sticky.
+func unixPermToFileMode(perm uint32) os.FileMode {
+	mode := os.FileMode(perm & 0777)
+	if perm&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perm&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perm&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// parseUnixTime parses "1524476603" or "1524476603.1234567890".
+func parseUnixTime(value string) (time.Time, error) {
+	parts := strings.SplitN(value, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid mtime %q", value)
+	}
+	nsec := int64(0)
+	if len(parts) == 2 {
+		fraction := (parts[1] + "000000000")[:9]
+		nsec, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid mtime %q", value)
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// execStat returns the metadata of a single file or os.ErrNotExist. Symlinks are followed if follow is set.
+func (fs *root) execStat(fileName string, follow bool) (*dockerFile, error) {
+	script := statScript
+	if follow {
+		script = statFollowScript
+	}
+	output, err := outputExecCmd(fs.containerID, []string{"sh", "-c", script, "sh", fileName}, fs.config.DockerUser)
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseStatOutput(output, filepath.Dir(fileName), fs.containerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, os.ErrNotExist
+	}
+	files[0].name = fileName
+	return files[0], nil
+}
+
+// execList returns the metadata of all files in a folder.
+func (fs *root) execList(folderName string) ([]*dockerFile, error) {
+	output, err := outputExecCmd(fs.containerID, []string{"sh", "-c", listScript, "sh", folderName}, fs.config.DockerUser)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatOutput(output, folderName, fs.containerID)
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statLine(fields ...string) string {
+	return strings.Join(fields, "\x00") + "\x00"
+}
+
+func TestParseStatOutput(t *testing.T) {
+	output := statLine("f", "644", "12", "1524476603.5000000000", "1000", "1001", "", "a b.txt") +
+		statLine("d", "755", "4096", "1524476603", "0", "0", "", "new\nline") +
+		statLine("l", "777", "7", "1524476603", "0", "0", "a b.txt", "link") +
+		statLine("f", "4755", "0", "1524476603", "0", "0", "", "setuid") +
+		statLine("c", "666", "0", "1524476603", "0", "0", "", "null")
+
+	files, err := parseStatOutput(output, "/var/www", "container")
+	if err != nil {
+		t.Fatalf("parseStatOutput failed: %s", err)
+	}
+	if len(files) != 5 {
+		t.Fatalf("Expected 5 files, got %d", len(files))
+	}
+
+	file := files[0]
+	if file.name != "/var/www/a b.txt" || file.Size() != 12 || file.Mode() != 0644 {
+		t.Errorf("Unexpected file %q size %d mode %s", file.name, file.Size(), file.Mode())
+	}
+	if !file.ModTime().Equal(time.Unix(1524476603, 500000000)) {
+		t.Errorf("Unexpected mtime %s", file.ModTime())
+	}
+	if file.uid != 1000 || file.gid != 1001 {
+		t.Errorf("Unexpected owner %d:%d", file.uid, file.gid)
+	}
+	if folder := files[1]; folder.name != "/var/www/new\nline" || !folder.IsDir() || folder.Mode() != os.ModeDir|0755 {
+		t.Errorf("Unexpected folder %q mode %s", folder.name, folder.Mode())
+	}
+	if link := files[2]; link.Mode()&os.ModeSymlink == 0 || link.symlink != "a b.txt" {
+		t.Errorf("Unexpected link mode %s target %q", link.Mode(), link.symlink)
+	}
+	if mode := files[3].Mode(); mode != os.ModeSetuid|0755 {
+		t.Errorf("Unexpected setuid mode %s", mode)
+	}
+	if mode := files[4].Mode(); mode != os.ModeDevice|os.ModeCharDevice|0666 {
+		t.Errorf("Unexpected device mode %s", mode)
+	}
+
+	if files, err := parseStatOutput("", "/", "container"); err != nil || len(files) != 0 {
+		t.Errorf("Empty output should return no files, got %d %v", len(files), err)
+	}
+	if _, err := parseStatOutput(statLine("f", "644", "12"), "/", "container"); err == nil {
+		t.Errorf("Truncated output should fail")
+	}
+	if _, err := parseStatOutput(statLine("x", "644", "12", "0", "0", "0", "", "a"), "/", "container"); err == nil {
+		t.Errorf("Unknown file type should fail")
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+// Symlink and hardlink handling of the sftp server. The cached files hold the lstat
+// metadata, Stat follows symlinks on request.
+
+import (
+	"github.com/andock/ssh2docksal/agent"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// linkTarget is returned for Readlink. The request server sends Name() as the target.
+type linkTarget struct {
+	os.FileInfo
+	target string
+}
+
+func (l linkTarget) Name() string { return l.target }
+
+// isSymlink reports whether file is a symlink.
+func (file *dockerFile) isSymlink() bool {
+	return file.Mode()&os.ModeSymlink != 0
+}
+
+// execFollow returns the metadata of the file a symlink points to. The name
+// stays the name of the link. Dangling symlinks return os.ErrNotExist, below
+// host mounts without asking the container unless they point out of the mount.
+func (fs *root) execFollow(link *dockerFile) (*dockerFile, error) {
+	if !link.isSymlink() {
+		return link, nil
+	}
+	var file *dockerFile
+	if ref := fs.hostFile(link.name); ref != nil {
+		defer ref.Close()
+		fi, err := ref.Lstat()
+		if err != nil {
+			return nil, err
+		}
+		file = newHostFile(link.name, fi, fs.containerID)
+	} else if a := fs.agent(); a != nil {
+		resp, err := a.call(&agent.Request{Op: agent.OpStat, Path: link.name})
+		if err == nil {
+			file = newAgentFile(filepath.Dir(link.name), resp.Info, fs.containerID)
+		} else if err != errAgentUnavailable {
+			return nil, err
+		}
+	}
+	if file == nil {
+		var err error
+		if file, err = fs.execStat(link.name, true); err != nil {
+			return nil, err
+		}
+	}
+	file.name = link.name
+	file.root = fs
+	return file, nil
+}
+
+// execReadlink returns the raw target of a symlink.
+func (fs *root) execReadlink(link *dockerFile) (string, error) {
+	if !link.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: link.name, Err: syscall.EINVAL}
+	}
+	if link.symlink != "" {
+		return link.symlink, nil
+	}
+	if ref := fs.hostPath(link.name); ref != nil {
+		defer ref.Close()
+		var target string
+		err := ref.do(func(path string) (err error) {
+			target, err = os.Readlink(path)
+			return err
+		})
+		return target, err
+	}
+	if a := fs.agent(); a != nil {
+		resp, err := a.call(&agent.Request{Op: agent.OpReadlink, Path: link.name})
+		if err != errAgentUnavailable {
+			if err != nil {
+				return "", err
+			}
+			return resp.Target, nil
+		}
+	}
+	output, err := outputExecCmd(fs.containerID, []string{"readlink", "--", link.name}, fs.config.DockerUser)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(output, "\n"), nil
+}
+
+// execSymlink creates the symlink link pointing to target. The target is
+// stored as given and resolved by the container.
+func (fs *root) execSymlink(target string, link string) error {
+	if ref := fs.hostPath(link); ref != nil {
+		defer ref.Close()
+		if ref.m.readOnly {
+			return os.ErrPermission
+		}
+		return ref.do(func(path string) error {
+			return os.Symlink(target, path)
+		})
+	}
+	if a := fs.agent(); a != nil {
+		_, err := a.call(&agent.Request{Op: agent.OpSymlink, Path: link, Target: target})
+		if err != errAgentUnavailable {
+			return err
+		}
+	}
+	// -T fails if link exists instead of creating the symlink inside of a folder link.
+	return simpleExec(fs.containerID, []string{"ln", "-s", "-T", "--", target, link}, fs.config.DockerUser)
+}
+
+// execLink creates the hardlink link of the existing file target.
+func (fs *root) execLink(target string, link string) error {
+	if ref := fs.hostPath(link); ref != nil {
+		defer ref.Close()
+		if targetRef := fs.hostPath(target); targetRef != nil {
+			defer targetRef.Close()
+			if targetRef.m == ref.m {
+				if ref.m.readOnly {
+					return os.ErrPermission
+				}
+				return ref.Link(targetRef)
+			}
+		}
+	}
+	if a := fs.agent(); a != nil {
+		_, err := a.call(&agent.Request{Op: agent.OpLink, Path: link, Target: target})
+		if err != errAgentUnavailable {
+			return err
+		}
+	}
+	// -T fails if link exists instead of creating the hardlink inside of a folder link.
+	return simpleExec(fs.containerID, []string{"ln", "-T", "--", target, link}, fs.config.DockerUser)
+}
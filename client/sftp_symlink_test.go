@@ -0,0 +1,73 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	os.MkdirAll(filepath.Join(dir, "sites/default/files"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sites/default/files/a.txt"), []byte("content"), 0644)
+	fs := &root{
+		files:      make(map[string]*dockerFile),
+		mounts:     []hostMount{{containerPath: "/var/www", hostPath: dir}},
+		userLoaded: true, uid: os.Getuid(), gid: os.Getgid(),
+	}
+
+	if err := fs.execSymlink("sites/default/files", "/var/www/files"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.execSymlink("missing", "/var/www/dangling"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.execSymlink("/var/www/missing/folder/file", "/var/www/deep"); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := fs.fetch("/var/www/files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !link.isSymlink() {
+		t.Fatalf("Expected a symlink, got %s", link.Mode())
+	}
+	target, err := fs.execReadlink(link)
+	if err != nil || target != "sites/default/files" {
+		t.Errorf("Expected the raw target, got %q %v", target, err)
+	}
+	followed, err := fs.execFollow(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !followed.IsDir() || followed.Name() != "files" {
+		t.Errorf("Expected the folder named after the link, got %s %s", followed.Name(), followed.Mode())
+	}
+
+	dangling, err := fs.fetch("/var/www/dangling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.execFollow(dangling); !os.IsNotExist(err) {
+		t.Errorf("Expected dangling symlinks to not exist, got %v", err)
+	}
+	deep, err := fs.fetch("/var/www/deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.execFollow(deep); !os.IsNotExist(err) {
+		t.Errorf("Expected symlinks into missing folders to not exist, got %v", err)
+	}
+
+	file, _ := fs.fetch("/var/www/sites/default/files/a.txt")
+	if _, err := fs.execReadlink(file); err == nil {
+		t.Errorf("Expected an error for readlink of a regular file")
+	}
+}
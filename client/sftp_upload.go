@@ -0,0 +1,517 @@
+package client
+
+// Spools sftp uploads to a local temp file and uploads them with a single
+// CopyToContainer call once the handle is closed or synced.
+// Atomic uploads are written to a hidden temp name next to the target and
+// renamed over it once complete.
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/andock/ssh2docksal/agent"
+	"github.com/apex/log"
+	"github.com/pkg/sftp"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pendingUpload is an upload which is not visible at the target path before it is closed.
+type pendingUpload interface {
+	// setstat sets the attributes the file gets when the upload is complete.
+	setstat(attrs *fileAttrs) error
+}
+
+// startUpload attaches an open upload to its file.
+func (fs *root) startUpload(file *dockerFile, upload pendingUpload) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	file.upload = upload
+}
+
+// upload returns the open upload of file or nil.
+func (fs *root) upload(file *dockerFile) pendingUpload {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	return file.upload
+}
+
+// finishUpload detaches a closed upload from its file.
+func (fs *root) finishUpload(file *dockerFile, upload pendingUpload) {
+	fs.filesLock.Lock()
+	defer fs.filesLock.Unlock()
+	if file.upload == upload {
+		file.upload = nil
+	}
+}
+
+// uploadMode returns the permissions of an upload. Existing files keep their mode.
+func (fs *root) uploadMode(file *dockerFile, exists bool) os.FileMode {
+	if exists && file.hasStat {
+		return file.mode.Perm() | file.mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	}
+	return fs.newFileMode()
+}
+
+// spoolWriter collects the writes of one sftp handle.
+type spoolWriter struct {
+	lock   sync.Mutex
+	file   *dockerFile
+	spool  *os.File
+	append bool
+	atomic bool
+	mode   os.FileMode
+	uid    int
+	gid    int
+	// mtime and atime are set by Setstat, the upload time is used otherwise.
+	mtime time.Time
+	atime time.Time
+	// dirty is set if the container file differs from the spool.
+	dirty  bool
+	closed bool
+	// failed is set if the connection dropped during the transfer.
+	failed bool
+	// batch commits the upload on close together with other uploads of the session.
+	batch *uploadBatch
+}
+
+// newSpoolWriter opens the spool of file. The current content is copied into
+// the spool unless the file is new or truncated, so offset writes and appends
+// only need the changed data from the client.
+func (fs *root) newSpoolWriter(file *dockerFile, flags sftp.FileOpenFlags, exists bool) (*spoolWriter, error) {
+	spool, err := ioutil.TempFile("", "ssh2docksal-upload")
+	if err != nil {
+		return nil, err
+	}
+	w := &spoolWriter{
+		file:   file,
+		spool:  spool,
+		append: flags.Append,
+		atomic: fs.config.AtomicUploads(),
+		mode:   fs.uploadMode(file, exists),
+		dirty:  !exists || flags.Trunc,
+	}
+	w.uid, w.gid = fs.execUser()
+	if exists && file.hasStat {
+		w.uid, w.gid = int(file.uid), int(file.gid)
+	}
+	if exists && !flags.Trunc && file.size != 0 {
+		content, err := openContainerFile(fs.containerID, file.name, fs.config.DockerUser, 0)
+		if err == nil {
+			_, err = io.Copy(spool, content)
+			content.Close()
+		}
+		if err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *spoolWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.append {
+		end, err := w.spool.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		off = end
+	}
+	if off < 0 || off+int64(len(p)) < off {
+		return 0, &os.PathError{Op: "write", Path: w.file.name, Err: syscall.EINVAL}
+	}
+	if err := w.file.checkWrite(off, len(p)); err != nil {
+		return 0, err
+	}
+	// Size limits of the spool (EFBIG, ENOSPC) are returned as path errors
+	// and reach the client as proper sftp status codes.
+	n, err := w.spool.WriteAt(p, off)
+	if n > 0 {
+		w.dirty = true
+	}
+	if err != nil {
+		return n, &os.PathError{Op: "write", Path: w.file.name, Err: underlyingError(err)}
+	}
+	return n, nil
+}
+
+// Sync uploads the current content without closing the handle.
+func (w *spoolWriter) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.commit()
+}
+
+// TransferError is called by the sftp request server if the connection dropped.
+func (w *spoolWriter) TransferError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.failed = true
+}
+
+func (w *spoolWriter) setstat(attrs *fileAttrs) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.file.root.restrictAttrs(attrs, w.uid, w.gid); err != nil {
+		return err
+	}
+	if attrs.flags.UidGid {
+		w.uid, w.gid = int(attrs.uid), int(attrs.gid)
+	}
+	if attrs.flags.Permissions {
+		w.mode = attrs.mode
+	}
+	if attrs.flags.Size {
+		if err := w.spool.Truncate(int64(attrs.size)); err != nil {
+			return &os.PathError{Op: "truncate", Path: w.file.name, Err: underlyingError(err)}
+		}
+	}
+	if attrs.flags.Acmodtime {
+		w.atime, w.mtime = attrs.atime, attrs.mtime
+	}
+	w.dirty = true
+	return nil
+}
+
+// Close uploads the content and removes the spool. Interrupted uploads are discarded.
+func (w *spoolWriter) Close() error {
+	w.file.root.finishUpload(w.file, w)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.batch != nil {
+		// The batch commits the upload, the sftp channel reports the result with the close response.
+		w.batch.add(w)
+		return nil
+	}
+	var err error
+	if w.failed {
+		log.Warnf("SFTP: Upload of %s was interrupted", w.file.name)
+	} else {
+		err = w.commit()
+	}
+	w.discard()
+	return err
+}
+
+func (w *spoolWriter) discard() {
+	w.spool.Close()
+	if err := os.Remove(w.spool.Name()); err != nil {
+		log.Errorf("SFTP: Unable to remove spool %s: %s", w.spool.Name(), err.Error())
+	}
+}
+
+// commit uploads the spool to the container if it changed.
+func (w *spoolWriter) commit() error {
+	if !w.dirty {
+		return nil
+	}
+	upload, err := w.prepare()
+	if err != nil {
+		return err
+	}
+	file := w.file
+	archive := archiveUploads([]*spoolUpload{upload}, filepath.Dir(upload.target))
+	err = file.execFileUpload(archive)
+	archive.CloseWithError(err)
+	if err == nil && w.atomic {
+		err = simpleExec(file.containerID, []string{"mv", "-f", "--", upload.target, file.name}, file.root.config.DockerUser)
+	}
+	if err != nil {
+		if w.atomic {
+			simpleExec(file.containerID, []string{"rm", "-f", "--", upload.target}, file.root.config.DockerUser)
+		}
+		return err
+	}
+	upload.done()
+	return nil
+}
+
+// spoolUpload is a spool prepared for the upload.
+type spoolUpload struct {
+	w *spoolWriter
+	// target is the path the spool is uploaded to, a temporary file for atomic uploads.
+	target string
+	header *tar.Header
+}
+
+// prepare returns the tar header of the spool.
+func (w *spoolWriter) prepare() (*spoolUpload, error) {
+	stat, err := w.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("SFTP: Upload %s (%d bytes)", w.file.name, stat.Size())
+	target := w.file.name
+	if w.atomic {
+		if target, err = atomicUploadName(w.file.name); err != nil {
+			return nil, err
+		}
+	}
+	mode := w.mode
+	if !w.file.root.keepsSetID(w.uid) {
+		// Written by another user than the owner.
+		mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	header := &tar.Header{
+		Mode:     int64(unixMode(mode)),
+		Size:     stat.Size(),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if !w.mtime.IsZero() {
+		header.ModTime, header.AccessTime = w.mtime, w.atime
+		header.Format = tar.FormatPAX
+	}
+	if w.uid >= 0 {
+		header.Uid, header.Gid = w.uid, w.gid
+	}
+	return &spoolUpload{w: w, target: target, header: header}, nil
+}
+
+// archiveUploads streams a tar of the spools to be extracted in folder.
+func archiveUploads(uploads []*spoolUpload, folder string) *io.PipeReader {
+	archive, archiveWriter := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(archiveWriter)
+		var err error
+		for _, upload := range uploads {
+			header := *upload.header
+			if header.Name, err = filepath.Rel(folder, upload.target); err != nil {
+				break
+			}
+			if err = tw.WriteHeader(&header); err != nil {
+				break
+			}
+			if _, err = io.Copy(tw, io.NewSectionReader(upload.w.spool, 0, header.Size)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		archiveWriter.CloseWithError(err)
+	}()
+	return archive
+}
+
+// done updates the cached file after the upload replaced it.
+func (upload *spoolUpload) done() {
+	w, file := upload.w, upload.w.file
+	w.dirty = false
+	file.root.changed(file.name)
+	file.size = upload.header.Size
+	file.modtime = upload.header.ModTime
+	if file.hasStat {
+		file.mode = file.mode&os.ModeType | w.mode
+	}
+	if w.uid >= 0 {
+		file.uid, file.gid = uint32(w.uid), uint32(w.gid)
+	}
+}
+
+// underlyingError unwraps the error of a failed file operation.
+func underlyingError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+// agentWriter writes through the agent. Atomic uploads are written to path
+// which replaces the target on close.
+type agentWriter struct {
+	lock   sync.Mutex
+	file   *dockerFile
+	agent  *agentClient
+	path   string
+	append bool
+	mode   os.FileMode
+	failed bool
+}
+
+// newAgentWriter opens the upload of file. Atomic uploads of files which are
+// not truncated start with a copy of the current content like the spool.
+func (fs *root) newAgentWriter(a *agentClient, file *dockerFile, flags sftp.FileOpenFlags, exists bool) (*agentWriter, error) {
+	w := &agentWriter{file: file, agent: a, path: file.name, mode: fs.uploadMode(file, exists)}
+	if fs.config.AtomicUploads() {
+		var err error
+		if w.path, err = atomicUploadName(file.name); err != nil {
+			return nil, err
+		}
+	} else if exists && flags.Trunc {
+		if err := file.execTruncate(0); err != nil {
+			return nil, err
+		}
+		file.size = 0
+	}
+	if w.path != file.name || !exists {
+		// Create the file. The umask of the agent must not apply.
+		if _, err := w.WriteAt(nil, 0); err != nil {
+			return nil, err
+		}
+		if w.path != file.name && exists && file.hasStat {
+			// The replaced file keeps its owner as far as the exec user may change it.
+			attrs := &fileAttrs{flags: sftp.FileAttrFlags{UidGid: true}, uid: file.uid, gid: file.gid}
+			if uid, gid := fs.execUser(); fs.restrictAttrs(attrs, uid, gid) == nil {
+				if _, err := a.call(&agent.Request{Op: agent.OpChown, Path: w.path, UID: file.uid, GID: file.gid}); err != nil {
+					a.call(&agent.Request{Op: agent.OpRemove, Path: w.path})
+					return nil, err
+				}
+			}
+			if !fs.keepsSetID(int(file.uid)) {
+				w.mode &^= os.ModeSetuid | os.ModeSetgid
+			}
+		}
+		// After the chown, which clears setuid and setgid.
+		if _, err := a.call(&agent.Request{Op: agent.OpChmod, Path: w.path, Mode: uint32(w.mode)}); err != nil {
+			a.call(&agent.Request{Op: agent.OpRemove, Path: w.path})
+			return nil, err
+		}
+	}
+	if w.path != file.name {
+		file.size = 0
+		if exists && !flags.Trunc {
+			if err := w.seed(); err != nil {
+				a.call(&agent.Request{Op: agent.OpRemove, Path: w.path})
+				return nil, err
+			}
+		}
+	} else if exists && flags.Append {
+		// Appends start at the current end, the cached size may be stale.
+		resp, err := a.call(&agent.Request{Op: agent.OpStat, Path: file.name})
+		if err != nil {
+			return nil, err
+		}
+		file.size = resp.Info.Size
+	}
+	w.append = flags.Append
+	return w, nil
+}
+
+// seed copies the content of the target into the atomic upload.
+func (w *agentWriter) seed() error {
+	reader := &agentReader{agent: w.agent, path: w.file.name}
+	buf := make([]byte, agent.MaxReadLength)
+	for {
+		n, err := reader.ReadAt(buf, w.file.size)
+		if n > 0 {
+			if _, err := w.agent.call(&agent.Request{Op: agent.OpWrite, Path: w.path, Offset: w.file.size, Data: buf[:n], Mode: uint32(w.mode)}); err != nil {
+				return err
+			}
+			w.file.size += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *agentWriter) setstat(attrs *fileAttrs) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := setAgentAttrs(w.agent, w.path, attrs); err != nil {
+		return err
+	}
+	if attrs.flags.Permissions {
+		w.mode = attrs.mode
+	}
+	return nil
+}
+
+func (w *agentWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.append {
+		off = w.file.size
+	}
+	if err := w.file.checkWrite(off, len(p)); err != nil {
+		return 0, err
+	}
+	_, err := w.agent.call(&agent.Request{Op: agent.OpWrite, Path: w.path, Offset: off, Data: p, Mode: uint32(w.mode)})
+	if err != nil {
+		return 0, err
+	}
+	if off+int64(len(p)) > w.file.size {
+		w.file.size = off + int64(len(p))
+	}
+	return len(p), nil
+}
+
+// TransferError is called by the sftp request server if the connection dropped.
+func (w *agentWriter) TransferError(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.failed = true
+}
+
+// Close renames an atomic upload over the target.
+func (w *agentWriter) Close() error {
+	w.file.root.finishUpload(w.file, w)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.path == w.file.name {
+		w.file.root.changed(w.file.name)
+		return nil
+	}
+	var err error
+	if w.failed {
+		log.Warnf("SFTP: Upload of %s was interrupted", w.file.name)
+	} else {
+		_, err = w.agent.call(&agent.Request{Op: agent.OpRename, Path: w.path, Target: w.file.name})
+		if err == nil {
+			w.file.root.changed(w.file.name)
+			w.file.modtime = time.Now()
+			return nil
+		}
+	}
+	w.agent.call(&agent.Request{Op: agent.OpRemove, Path: w.path})
+	return err
+}
+
+// atomicUploadName returns a hidden temp name in the folder of name.
+func atomicUploadName(name string) (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	base := filepath.Base(name)
+	if len(base) > 200 {
+		base = base[:200]
+	}
+	return filepath.Join(filepath.Dir(name), "."+base+".ssh2docksal-"+hex.EncodeToString(random)), nil
+}
+
+// unixMode converts the permissions of mode including setuid, setgid and sticky to unix bits.
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"encoding/gob"
+	"github.com/andock/ssh2docksal"
+	"github.com/andock/ssh2docksal/agent"
+	"github.com/pkg/sftp"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func newTestSpoolWriter(t *testing.T, appendMode bool) *spoolWriter {
+	spool, err := ioutil.TempFile("", "ssh2docksal-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &spoolWriter{file: newDockerFile("/var/www/test.txt", false, "container"), spool: spool, append: appendMode}
+}
+
+func spoolContent(t *testing.T, w *spoolWriter) string {
+	content, err := ioutil.ReadFile(w.spool.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSpoolWriter(t *testing.T) {
+	w := newTestSpoolWriter(t, false)
+	defer w.discard()
+	if w.dirty {
+		t.Errorf("Spool should not be dirty before the first write")
+	}
+	w.WriteAt([]byte("world"), 6)
+	w.WriteAt([]byte("hello "), 0)
+	if content := spoolContent(t, w); content != "hello world" {
+		t.Errorf("Offset writes should be spooled, got %q", content)
+	}
+	if !w.dirty {
+		t.Errorf("Spool should be dirty after writes")
+	}
+	_, err := w.WriteAt([]byte("x"), -1)
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.EINVAL {
+		t.Errorf("Negative offsets should fail with EINVAL, got %v", err)
+	}
+
+	a := newTestSpoolWriter(t, true)
+	a.WriteAt([]byte("first"), 0)
+	a.WriteAt([]byte(" second"), 0)
+	if content := spoolContent(t, a); content != "first second" {
+		t.Errorf("Appends should ignore the offset, got %q", content)
+	}
+	if _, err := os.Stat(a.spool.Name()); err != nil {
+		t.Fatal(err)
+	}
+	a.discard()
+	if _, err := os.Stat(a.spool.Name()); !os.IsNotExist(err) {
+		t.Errorf("Spool should be removed")
+	}
+}
+
+// newTestAgent serves agent requests in the test process.
+func newTestAgent() *agentClient {
+	requests, requestWriter := io.Pipe()
+	responses, responseWriter := io.Pipe()
+	go agent.Serve(requests, responseWriter)
+	return &agentClient{enc: gob.NewEncoder(requestWriter), dec: gob.NewDecoder(responses), conn: requestWriter}
+}
+
+func TestAgentWriterAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := newTestAgent()
+	defer a.close()
+
+	for _, atomic := range []bool{false, true} {
+		name := filepath.Join(dir, "log.txt")
+		ioutil.WriteFile(name, []byte("first"), 0644)
+		fs := &root{files: make(map[string]*dockerFile)}
+		if atomic {
+			fs.config.AtomicUploadServices = []string{"*"}
+		}
+		file := newDockerFile(name, false, "container")
+		file.root = fs
+		w, err := fs.newAgentWriter(a, file, sftp.FileOpenFlags{Write: true, Append: true}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteAt([]byte(" second"), 0)
+		w.WriteAt([]byte(" third"), 0)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := ioutil.ReadFile(name); string(content) != "first second third" {
+			t.Errorf("Appends should ignore the offset (atomic %v), got %q", atomic, content)
+		}
+	}
+}
+
+func TestAgentWriterAtomicOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the owner needs root")
+	}
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := newTestAgent()
+	defer a.close()
+
+	name := filepath.Join(dir, "index.php")
+	ioutil.WriteFile(name, []byte("old"), 0644)
+	os.Chown(name, 1234, 2345)
+	fs := &root{files: make(map[string]*dockerFile), userLoaded: true}
+	fs.config.AtomicUploadServices = []string{"*"}
+	file := newDockerFile(name, false, "container")
+	file.root = fs
+	file.mode, file.uid, file.gid, file.hasStat = 0644, 1234, 2345, true
+	w, err := fs.newAgentWriter(a, file, sftp.FileOpenFlags{Write: true, Trunc: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("new"), 0)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys := stat.Sys().(*syscall.Stat_t); sys.Uid != 1234 || sys.Gid != 2345 {
+		t.Errorf("Expected the replaced file to keep its owner, got %d:%d", sys.Uid, sys.Gid)
+	}
+	if stat.Mode().Perm() != 0644 {
+		t.Errorf("Expected the replaced file to keep its mode, got %s", stat.Mode())
+	}
+}
+
+func TestUploadMode(t *testing.T) {
+	fs := &root{config: ssh2docksal.Config{Umask: "0002"}}
+	file := newDockerFile("/var/www/test.sh", false, "container")
+	if mode := fs.uploadMode(file, false); mode != 0664 {
+		t.Errorf("New files should get 0666 without umask, got %o", mode)
+	}
+	file.mode, file.hasStat = os.ModeSetuid|0750, true
+	if mode := fs.uploadMode(file, true); mode != os.ModeSetuid|0750 {
+		t.Errorf("Existing files should keep their mode, got %s", mode)
+	}
+	if bits := unixMode(os.ModeSetuid | os.ModeSticky | 0750); bits != 05750 {
+		t.Errorf("unixMode should convert special bits, got %o", bits)
+	}
+}
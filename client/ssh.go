@@ -63,6 +63,15 @@ func (a *DockerClient) Find(containerName string) (string, error) {
 
 func dockerExec(containerID string, command string, cfg container.Config, sess ssh.Session, config ssh2docksal.Config) (status int, err error) {
 	log.Debugf("SSH: Execute command: %s", command)
+	cmd := []string{"/bin/bash"}
+	if command != "" {
+		cmd = append(cmd, "-lc", command)
+	}
+	return dockerExecCmd(containerID, cmd, cfg, sess, config)
+}
+
+// dockerExecCmd runs cmd without a shell and connects it to the ssh session.
+func dockerExecCmd(containerID string, cmd []string, cfg container.Config, sess ssh.Session, config ssh2docksal.Config) (status int, err error) {
 	status = 255
 	ctx := context.Background()
 	docker, err := client.NewEnvClient()
@@ -82,13 +91,7 @@ func dockerExec(containerID string, command string, cfg container.Config, sess s
 		Detach:       false,
 		Tty:          cfg.Tty,
 	}
-	ec.Cmd = append(ec.Cmd, "/bin/bash")
-
-	if command != "" {
-		ec.Cmd = append(ec.Cmd, "-lc")
-		ec.Cmd = append(ec.Cmd, command)
-	}
-
+	ec.Cmd = cmd
 	ec.User = config.DockerUser
 	eresp, err := docker.ContainerExecCreate(context.Background(), containerID, ec)
 	if err != nil {
@@ -154,8 +157,48 @@ func (a *DockerClient) Execute(containerID string, s ssh.Session, c ssh2docksal.
 	_, _, isPty := s.Pty()
 	cfg := container.Config{AttachStdin: true, AttachStderr: true, AttachStdout: true, Tty: isPty}
 	_, err := dockerExec(containerID, strings.Join(s.Command(), " "), cfg, s, c)
+	containerChanged(containerID)
 	if err != nil {
 		s.Exit(255)
 	}
 
 }
+
+// sftpServerPaths are the common locations of the OpenSSH sftp-server binary.
+var sftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+	"/usr/lib/sftp-server",
+}
+
+// findSftpServer looks up the sftp-server binary in the container.
+func findSftpServer(containerID string, dockerUser string) (string, error) {
+	command := "for p in " + strings.Join(sftpServerPaths, " ") + "; do if [ -x \"$p\" ]; then echo \"$p\"; exit 0; fi; done; command -v sftp-server || true"
+	output, err := outpuExec(containerID, []string{"sh", "-c", command}, dockerUser)
+	if err != nil {
+		return "", err
+	}
+	if output == "" {
+		return "", ssh2docksal.ErrSftpServerNotFound
+	}
+	return strings.Split(output, "\n")[0], nil
+}
+
+// SftpPassthrough pipes the sftp subsystem into the sftp-server binary of the container.
+func (a *DockerClient) SftpPassthrough(containerID string, s ssh.Session, c ssh2docksal.Config) error {
+	sftpServer, err := findSftpServer(containerID, c.DockerUser)
+	if err != nil {
+		return err
+	}
+	log.Debugf("SFTP: Use %s", sftpServer)
+	cfg := container.Config{AttachStdin: true, AttachStderr: true, AttachStdout: true, Tty: false}
+	status, err := dockerExecCmd(containerID, []string{sftpServer}, cfg, s, c)
+	containerChanged(containerID)
+	if err != nil {
+		return err
+	}
+	s.Exit(status)
+	return nil
+}
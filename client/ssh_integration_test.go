@@ -1,6 +1,8 @@
 package client
 
 import (
+	"github.com/andock/ssh2docksal"
+	"strings"
 	"testing"
 )
 
@@ -17,3 +19,20 @@ func TestDockerClient_Find(t *testing.T) {
 		t.Errorf("unexpected empty container id")
 	}
 }
+
+func TestFindSftpServer(t *testing.T) {
+	if !*testIntegration {
+		t.Skip("skipping integration test")
+	}
+	containerID := getTestContainerId()
+	sftpServer, err := findSftpServer(containerID, "docker")
+	if err == ssh2docksal.ErrSftpServerNotFound {
+		t.Skip("container has no sftp-server")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(sftpServer, "/") {
+		t.Errorf("sftp-server path should be absolute: %s", sftpServer)
+	}
+}
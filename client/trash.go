@@ -0,0 +1,221 @@
+package client
+
+// Trash of sftp removals. With Config.SftpTrash set, Remove and Rmdir move
+// their target into the trash folder of the container instead of deleting
+// it. Each session gets an entry named after its start time, every removal
+// a numbered item in it. The removed paths keep their place below the item
+// and are recorded in the .trashed file of the entry. Entries are purged once their last removal is older than the
+// retention. The ssh2docksal-trash command lists and restores the files.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/andock/ssh2docksal"
+	"github.com/apex/log"
+	"github.com/gliderlabs/ssh"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trashScript moves a file ($3 = remove) or an empty folder ($3 = rmdir) $4
+// into the item $5 of the entry $2 of the trash folder $1. Trashed files are
+// never replaced. Files on another file system than
+// the trash, e.g. a bind mount, are copied by mv, which blocks the removal
+// until the copy is done.
+const trashScript = `entry=$1/$2 name=$4
+target=$entry/$5$name
+if [ -e "$target" ] || [ -L "$target" ]; then
+	echo "$target exists already" >&2
+	exit 1
+fi
+mkdir -p -- "$(dirname -- "$target")" || exit 1
+if [ "$3" = rmdir ]; then
+	[ -d "$name" ] && [ ! -L "$name" ] || { echo "$name: Not a directory" >&2; exit 1; }
+	mkdir -- "$target" && rmdir -- "$name" || exit 1
+else
+	[ -d "$name" ] && [ ! -L "$name" ] && { echo "$name: Is a directory" >&2; exit 1; }
+	mv -- "$name" "$target" || exit 1
+fi
+printf '%s\t%s\t%s\n' "$(date +%s)" "$5" "$name" >> "$entry/.trashed"`
+
+// listTrashScript prints item, time and path of the trashed files of $1
+// which were not restored, tab separated.
+const listTrashScript = `cd -- "$1" 2>/dev/null || exit 0
+for log in */.trashed; do
+	[ -f "$log" ] || continue
+	entry=${log%/.trashed}
+	while IFS='	' read -r time n name; do
+		item=$entry/$n
+		if [ -z "$name" ]; then
+			# Entries without numbered items.
+			item=$entry name=$n
+		fi
+		if [ -e "$item$name" ] || [ -L "$item$name" ]; then
+			printf '%s\t%s\t%s\n' "$item" "$time" "$name"
+		fi
+	done < "$log"
+done`
+
+// purgeTrashScript removes the entries of $1 whose last removal is older than $2 minutes.
+const purgeTrashScript = `cd -- "$1" 2>/dev/null || exit 0
+for log in */.trashed; do
+	if [ -f "$log" ] && [ -n "$(find "$log" -mmin +"$2")" ]; then
+		rm -rf -- "${log%/.trashed}"
+	fi
+done
+true`
+
+// restoreTrashScript moves $3 from the item $2 of the trash folder $1 back.
+// Trashed folders are merged into existing folders, existing files are kept.
+const restoreTrashScript = `src=$1/$2$3 name=$3
+[ -e "$src" ] || [ -L "$src" ] || { echo "$name is not in the trash entry $2" >&2; exit 1; }
+if [ ! -e "$name" ] && [ ! -L "$name" ]; then
+	mkdir -p -- "$(dirname -- "$name")" && mv -- "$src" "$name"
+elif [ -d "$name" ] && [ -d "$src" ] && [ ! -L "$src" ]; then
+	cp -Rpn -- "$src/." "$name/" && rm -rf -- "$src"
+else
+	echo "$name exists already" >&2
+	exit 1
+fi`
+
+// useTrash checks if removing name moves it to the trash. Removals in the trash delete the files.
+func (fs *root) useTrash(name string) bool {
+	trash := fs.config.GetSftpTrash()
+	return trash != "" && name != trash && !strings.HasPrefix(name, trash+"/")
+}
+
+// execTrash moves the file or empty folder to the trash entry of the session.
+func (fs *root) execTrash(file *dockerFile, rmdir bool) error {
+	entry, item, err := fs.nextTrashItem()
+	if err != nil {
+		return err
+	}
+	mode := "remove"
+	if rmdir {
+		mode = "rmdir"
+	}
+	log.Debugf("SFTP: Move %s to the trash", file.name)
+	return simpleExec(fs.containerID, []string{"sh", "-c", trashScript, "sh", fs.config.GetSftpTrash(), entry, mode, file.name, strconv.Itoa(item)}, fs.config.DockerUser)
+}
+
+// nextTrashItem returns the trash entry of the session and the number of the
+// next removal in it. The first call names the entry and purges the old ones.
+func (fs *root) nextTrashItem() (string, int, error) {
+	fs.trashLock.Lock()
+	defer fs.trashLock.Unlock()
+	if fs.trashEntry == "" {
+		random := make([]byte, 4)
+		if _, err := rand.Read(random); err != nil {
+			return "", 0, err
+		}
+		fs.trashEntry = time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(random)
+		purgeTrash(fs.containerID, fs.config)
+	}
+	fs.trashItems++
+	return fs.trashEntry, fs.trashItems, nil
+}
+
+// purgeTrash removes the trash entries older than the retention.
+func purgeTrash(containerID string, config ssh2docksal.Config) {
+	minutes := strconv.Itoa(int(config.GetSftpTrashRetention().Minutes()))
+	if err := simpleExec(containerID, []string{"sh", "-c", purgeTrashScript, "sh", config.GetSftpTrash(), minutes}, config.DockerUser); err != nil {
+		log.Warnf("Unable to purge the trash %s: %s", config.GetSftpTrash(), err.Error())
+	}
+}
+
+// trashedFile is a file in the trash. entry is the item of its removal in the
+// entry of the session.
+type trashedFile struct {
+	entry string
+	time  time.Time
+	name  string
+}
+
+// listTrash returns the trashed files which were not restored, the latest first.
+func listTrash(containerID string, config ssh2docksal.Config) ([]trashedFile, error) {
+	purgeTrash(containerID, config)
+	output, err := outputExecCmd(containerID, []string{"sh", "-c", listTrashScript, "sh", config.GetSftpTrash()}, config.DockerUser)
+	if err != nil {
+		return nil, err
+	}
+	return parseTrashList(output), nil
+}
+
+// parseTrashList parses the output of listTrashScript. Files removed more
+// than once are listed per removal.
+func parseTrashList(output string) []trashedFile {
+	var files []trashedFile
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		seconds, _ := strconv.ParseInt(fields[1], 10, 64)
+		files = append(files, trashedFile{entry: fields[0], time: time.Unix(seconds, 0), name: fields[2]})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].time.After(files[j].time)
+	})
+	return files
+}
+
+// restoreTrash moves name of the item entry, e.g. 20261019-101500-3f2a9c1e/3,
+// back to its place.
+func restoreTrash(containerID string, config ssh2docksal.Config, entry string, name string) error {
+	session, item := entry, ""
+	if i := strings.Index(entry, "/"); i >= 0 {
+		session, item = entry[:i], entry[i+1:]
+	}
+	if n, err := strconv.Atoi(item); item != "" && (err != nil || n < 1 || strconv.Itoa(n) != item) {
+		return fmt.Errorf("Invalid trash entry %s", entry)
+	}
+	if session == "" || session == "." || session == ".." {
+		return fmt.Errorf("Invalid trash entry %s", entry)
+	}
+	if !path.IsAbs(name) {
+		return fmt.Errorf("Path %s is not absolute", name)
+	}
+	return simpleExec(containerID, []string{"sh", "-c", restoreTrashScript, "sh", config.GetSftpTrash(), entry, path.Clean(name)}, config.DockerUser)
+}
+
+// trashCommand runs the ssh2docksal-trash command with args and returns its output.
+func trashCommand(containerID string, config ssh2docksal.Config, args []string) (string, error) {
+	if config.GetSftpTrash() == "" {
+		return "", fmt.Errorf("The trash is disabled")
+	}
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		files, err := listTrash(containerID, config)
+		if err != nil {
+			return "", err
+		}
+		var output strings.Builder
+		for _, file := range files {
+			fmt.Fprintf(&output, "%s  %s  %s\n", file.entry, file.time.Format("2006-01-02 15:04:05"), file.name)
+		}
+		return output.String(), nil
+	case len(args) == 3 && args[0] == "restore":
+		if err := restoreTrash(containerID, config, args[1], args[2]); err != nil {
+			return "", err
+		}
+		return "Restored " + path.Clean(args[2]) + "\n", nil
+	}
+	return "", fmt.Errorf("Usage: ssh2docksal-trash list | restore <entry> <path>")
+}
+
+// Trash runs the ssh2docksal-trash command which lists and restores the files removed via sftp.
+func (a *DockerClient) Trash(containerID string, s ssh.Session, c ssh2docksal.Config) {
+	output, err := trashCommand(containerID, c, s.Command()[1:])
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "%s\n", err.Error())
+		s.Exit(1)
+		return
+	}
+	io.WriteString(s, output)
+	s.Exit(0)
+}
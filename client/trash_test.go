@@ -0,0 +1,121 @@
+package client
+
+import (
+	"github.com/andock/ssh2docksal"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrashScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trash := filepath.Join(dir, "trash")
+	files := filepath.Join(dir, "www")
+	os.MkdirAll(filepath.Join(files, "themes/shop"), 0755)
+	ioutil.WriteFile(filepath.Join(files, "themes/shop/page.twig"), []byte("page"), 0644)
+	run := func(script string, args ...string) (string, error) {
+		output, err := exec.Command("sh", append([]string{"-c", script, "sh"}, args...)...).CombinedOutput()
+		return string(output), err
+	}
+
+	page := filepath.Join(files, "themes/shop/page.twig")
+	if _, err := run(trashScript, trash, "entry", "remove", page, "1"); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(page, []byte("new page"), 0644)
+	if output, err := run(trashScript, trash, "entry", "remove", page, "1"); err == nil {
+		t.Errorf("Expected trashed files not to be replaced, got %s", output)
+	}
+	if _, err := run(trashScript, trash, "entry", "remove", page, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := run(trashScript, trash, "entry", "remove", filepath.Join(files, "themes/shop"), "3"); err == nil {
+		t.Errorf("Expected folders to be refused by remove, got %s", output)
+	}
+	if output, err := run(trashScript, trash, "entry", "rmdir", filepath.Join(files, "themes/shop"), "4"); err != nil {
+		t.Fatal(output)
+	}
+	if _, err := os.Stat(filepath.Join(files, "themes/shop")); !os.IsNotExist(err) {
+		t.Errorf("Expected the folder to be removed")
+	}
+
+	output, err := run(listTrashScript, trash)
+	if err != nil {
+		t.Fatal(output)
+	}
+	list := parseTrashList(output)
+	if len(list) != 3 || list[0].entry != "entry/1" || list[1].entry != "entry/2" || list[2].entry != "entry/4" || time.Since(list[0].time) > time.Minute {
+		t.Fatalf("Expected both versions of the file and the folder, got %+v", list)
+	}
+
+	folder := filepath.Join(files, "themes/shop")
+	if output, err := run(restoreTrashScript, trash, "entry/4", folder); err != nil {
+		t.Fatal(output)
+	}
+	if output, err := run(restoreTrashScript, trash, "entry/1", page); err != nil {
+		t.Fatal(output)
+	}
+	if content, _ := ioutil.ReadFile(page); string(content) != "page" {
+		t.Errorf("Expected the first version to be restored, got %q", content)
+	}
+	if output, err := run(restoreTrashScript, trash, "entry/2", page); err == nil {
+		t.Errorf("Expected existing files to be kept, got %s", output)
+	}
+	os.Remove(page)
+	if output, err := run(restoreTrashScript, trash, "entry/2", page); err != nil {
+		t.Fatal(output)
+	}
+	if content, _ := ioutil.ReadFile(page); string(content) != "new page" {
+		t.Errorf("Expected the second version to be restored, got %q", content)
+	}
+	if output, _ := run(listTrashScript, trash); output != "" {
+		t.Errorf("Expected restored files not to be listed, got %q", output)
+	}
+	if _, err := run(restoreTrashScript, trash, "entry/4", folder); err == nil {
+		t.Errorf("Expected files which are not in the trash to fail")
+	}
+
+	run(purgeTrashScript, trash, "1")
+	if _, err := os.Stat(filepath.Join(trash, "entry")); err != nil {
+		t.Errorf("Expected recent entries to be kept")
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(trash, "entry/.trashed"), old, old)
+	run(purgeTrashScript, trash, "30")
+	if _, err := os.Stat(filepath.Join(trash, "entry")); !os.IsNotExist(err) {
+		t.Errorf("Expected old entries to be purged")
+	}
+}
+
+func TestParseTrashList(t *testing.T) {
+	list := parseTrashList("a/1\t100\t/var/www/a.txt\nb/1\t200\t/var/www/b.txt\na/2\t150\t/var/www/a.txt\ninvalid\n")
+	if len(list) != 3 || list[0].name != "/var/www/b.txt" || list[1].entry != "a/2" || list[2].time.Unix() != 100 {
+		t.Errorf("Expected every removal with the latest first, got %+v", list)
+	}
+}
+
+func TestUseTrash(t *testing.T) {
+	fs := &root{config: ssh2docksal.Config{SftpTrash: "/var/www/.trash"}}
+	if !fs.useTrash("/var/www/index.php") || fs.useTrash("/var/www/.trash/entry/var/www/index.php") || fs.useTrash("/var/www/.trash") {
+		t.Errorf("Expected removals outside of the trash only to use the trash")
+	}
+	unclean := &root{config: ssh2docksal.Config{SftpTrash: "/var/www/.trash/"}}
+	if unclean.useTrash("/var/www/.trash/entry/var/www/index.php") {
+		t.Errorf("Expected removals in an unclean trash folder to delete the files")
+	}
+	if (&root{}).useTrash("/var/www/index.php") {
+		t.Errorf("Expected the trash to be disabled by default")
+	}
+	for _, entry := range []string{"../x", "entry/0", "entry/x", "entry/1/2", "/1"} {
+		if _, err := trashCommand("container", ssh2docksal.Config{SftpTrash: "/var/www/.trash"}, []string{"restore", entry, "/var/www"}); err == nil {
+			t.Errorf("Expected the invalid entry %s to fail", entry)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package ssh2docksal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// UploadHook is a command run in the container after sftp uploads or renames
+// of matching files completed.
+type UploadHook struct {
+	// Project and Service select the sessions, empty values match all sessions.
+	Project string `json:"project"`
+	Service string `json:"service"`
+	// Paths lists glob patterns of the files. Patterns without a slash match
+	// file names, others match container paths.
+	Paths []string `json:"paths"`
+	// Command is run with sh -c as the user of the session, the files are its arguments.
+	Command string `json:"command"`
+	// Debounce is how long the hook waits for more files after an upload, e.g. "2s". Default is 500ms.
+	Debounce string `json:"debounce"`
+	// Report runs the hook before the upload is confirmed. If it fails the
+	// client gets its output as error and the hook isn't debounced.
+	Report bool `json:"report"`
+}
+
+// matches checks if the hook applies to the session of config.
+func (hook *UploadHook) matches(config *Config) bool {
+	return (hook.Project == "" || hook.Project == config.Project) &&
+		(hook.Service == "" || hook.Service == config.Service)
+}
+
+// Matches checks if the hook applies to the container path name.
+func (hook *UploadHook) Matches(name string) bool {
+	for _, pattern := range hook.Paths {
+		subject := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			subject = name
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDebounce returns how long the hook waits for more files.
+func (hook *UploadHook) GetDebounce() time.Duration {
+	debounce, err := time.ParseDuration(hook.Debounce)
+	if hook.Debounce == "" || err != nil {
+		return 500 * time.Millisecond
+	}
+	return debounce
+}
+
+// GetUploadHooks returns the upload hooks of the current session.
+func (config *Config) GetUploadHooks() []UploadHook {
+	var hooks []UploadHook
+	for _, hook := range config.UploadHooks {
+		if hook.matches(config) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// LoadUploadHooks reads a JSON list of upload hooks.
+func LoadUploadHooks(file string) ([]UploadHook, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []UploadHook
+	if err := json.Unmarshal(content, &hooks); err != nil {
+		return nil, fmt.Errorf("Invalid upload hook file %s: %s", file, err.Error())
+	}
+	for _, hook := range hooks {
+		if hook.Command == "" || len(hook.Paths) == 0 {
+			return nil, fmt.Errorf("Upload hook without command or paths in %s", file)
+		}
+		for _, pattern := range hook.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid upload hook pattern %s", pattern)
+			}
+		}
+		if _, err := time.ParseDuration(hook.Debounce); hook.Debounce != "" && err != nil {
+			return nil, fmt.Errorf("Invalid upload hook debounce %s", hook.Debounce)
+		}
+	}
+	return hooks, nil
+}
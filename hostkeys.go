@@ -0,0 +1,211 @@
+package ssh2docksal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HostKeyTypes are the types of host keys generated by default, the preferred first.
+var HostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// DefaultHostKeys returns the paths of the default host keys in dir.
+func DefaultHostKeys(dir string) []string {
+	var paths []string
+	for _, keyType := range HostKeyTypes {
+		paths = append(paths, filepath.Join(dir, "ssh_host_"+keyType+"_key"))
+	}
+	return paths
+}
+
+// hostKeyType returns the key type in the file name of path.
+func hostKeyType(path string) (string, error) {
+	name := filepath.Base(path)
+	for _, keyType := range HostKeyTypes {
+		if strings.Contains(name, keyType) {
+			return keyType, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown type of host key %s, its name has to contain ed25519, ecdsa or rsa", path)
+}
+
+// LoadHostKeys reads the host keys at paths. Missing keys are generated with
+// the type in their file name and stored together with their public key.
+func LoadHostKeys(paths []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			content, err = generateHostKey(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, err := gossh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid host key %s: %s", path, err.Error())
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// HostKeys serves the host keys signers.
+func HostKeys(signers []ssh.Signer) ssh.Option {
+	return func(srv *ssh.Server) error {
+		for _, signer := range signers {
+			srv.AddHostKey(signer)
+		}
+		return nil
+	}
+}
+
+// generateHostKey creates the host key path and returns its PEM encoding.
+func generateHostKey(path string) ([]byte, error) {
+	keyType, err := hostKeyType(path)
+	if err != nil {
+		return nil, err
+	}
+	var block *pem.Block
+	var public gossh.PublicKey
+	switch keyType {
+	case "ed25519":
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if public, err = gossh.NewPublicKey(publicKey); err != nil {
+			return nil, err
+		}
+		encoded, err := marshalED25519(public, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: encoded}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if public, err = gossh.NewPublicKey(&key.PublicKey); err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return nil, err
+		}
+		if public, err = gossh.NewPublicKey(&key.PublicKey); err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	content := pem.EncodeToMemory(block)
+	if err := writeFileAtomic(path, content, 0600); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path+".pub", gossh.MarshalAuthorizedKey(public), 0644); err != nil {
+		return nil, err
+	}
+	log.Infof("Generated %s host key %s %s", keyType, path, KeyFingerprint(public))
+	return content, nil
+}
+
+// marshalED25519 encodes an ed25519 key in the unencrypted openssh-key-v1 format.
+func marshalED25519(public gossh.PublicKey, key ed25519.PrivateKey) ([]byte, error) {
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	private := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check),
+		Check2:  binary.BigEndian.Uint32(check),
+		Keytype: gossh.KeyAlgoED25519,
+		Pub:     []byte(key.Public().(ed25519.PublicKey)),
+		Priv:    []byte(key),
+	}
+	// The private block is padded to the cipher block size of 8 with 1, 2, 3, ...
+	for i := 0; (len(gossh.Marshal(private)))%8 != 0; i++ {
+		private.Pad = append(private.Pad, byte(i+1))
+	}
+	envelope := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       public.Marshal(),
+		PrivKeyBlock: gossh.Marshal(private),
+	}
+	return append([]byte("openssh-key-v1\x00"), gossh.Marshal(envelope)...), nil
+}
+
+// writeFileAtomic writes content to a temporary file and renames it to path.
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// HostKeyFingerprints returns a line per host key with type, SHA256 fingerprint and path.
+func HostKeyFingerprints(paths []string) ([]string, error) {
+	signers, err := LoadHostKeys(paths)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for i, signer := range signers {
+		key := signer.PublicKey()
+		lines = append(lines, fmt.Sprintf("%s %s %s", key.Type(), KeyFingerprint(key), paths[i]))
+	}
+	return lines, nil
+}
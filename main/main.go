@@ -1,12 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"github.com/andock/ssh2docksal"
 	"github.com/andock/ssh2docksal/client"
 	"github.com/apex/log"
 	"github.com/codegangsta/cli"
 	"github.com/gliderlabs/ssh"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // StartServer is the default cli action
@@ -34,18 +39,171 @@ func StartServer(c *cli.Context) {
 	}
 	log.SetLevel(level)
 
+	sftpMode := c.String("sftp-mode")
+	if !ssh2docksal.IsValidSftpMode(sftpMode) {
+		log.Warn("No valid sftp mode " + sftpMode)
+		return
+	}
+	sftpServiceModes := map[string]string{}
+	for _, serviceMode := range c.StringSlice("sftp-service-mode") {
+		parts := strings.SplitN(serviceMode, "=", 2)
+		if len(parts) != 2 || !ssh2docksal.IsValidSftpMode(parts[1]) {
+			log.Warn("No valid sftp service mode " + serviceMode)
+			return
+		}
+		sftpServiceModes[parts[0]] = parts[1]
+	}
+
+	umask := c.String("umask")
+	if !ssh2docksal.IsValidUmask(umask) {
+		log.Warn("No valid umask " + umask)
+		return
+	}
+
+	var sftpPolicies []ssh2docksal.SftpPolicy
+	if policyFile := c.String("sftp-policy-file"); policyFile != "" {
+		policies, err := ssh2docksal.LoadSftpPolicies(policyFile)
+		if err != nil {
+			log.Warn(err.Error())
+			return
+		}
+		sftpPolicies = policies
+	}
+
+	sftpLimits := map[string]int64{}
+	for _, name := range []string{"sftp-max-file-size", "sftp-session-quota", "sftp-daily-quota", "sftp-min-free-space"} {
+		size, err := ssh2docksal.ParseSize(c.String(name))
+		if err != nil {
+			log.Warn("No valid " + name + " " + c.String(name))
+			return
+		}
+		sftpLimits[name] = size
+	}
+
+	sftpTrash := c.String("sftp-trash")
+	if sftpTrash != "" {
+		if !filepath.IsAbs(sftpTrash) {
+			log.Warn("Sftp trash " + sftpTrash + " is not absolute")
+			return
+		}
+		sftpTrash = path.Clean(sftpTrash)
+	}
+
+	var uploadHooks []ssh2docksal.UploadHook
+	if hooksFile := c.String("sftp-hooks-file"); hooksFile != "" {
+		hooks, err := ssh2docksal.LoadUploadHooks(hooksFile)
+		if err != nil {
+			log.Warn(err.Error())
+			return
+		}
+		uploadHooks = hooks
+	}
+
+	var transferRates []*ssh2docksal.TransferRate
+	for _, value := range c.StringSlice("transfer-rate") {
+		rate, err := ssh2docksal.ParseTransferRate(value)
+		if err != nil {
+			log.Warn(err.Error())
+			return
+		}
+		transferRates = append(transferRates, rate)
+	}
+	channelRate, err := ssh2docksal.ParseSize(c.String("channel-rate"))
+	if err != nil {
+		log.Warn("No valid channel-rate " + c.String("channel-rate"))
+		return
+	}
+
+	var auditLog *ssh2docksal.AuditLog
+	if auditDest := c.String("audit-log"); auditDest != "" {
+		maxSize, err := ssh2docksal.ParseSize(c.String("audit-log-max-size"))
+		if err != nil {
+			log.Warn("No valid audit-log-max-size " + c.String("audit-log-max-size"))
+			return
+		}
+		auditLog, err = ssh2docksal.OpenAuditLog(auditDest, maxSize, c.Int("audit-log-keep"))
+		if err != nil {
+			log.Warn("Unable to open the audit log " + auditDest + ": " + err.Error())
+			return
+		}
+	}
+
+	agentPath := c.String("agent")
+	if agentPath != "" {
+		if _, err := os.Stat(agentPath); err != nil {
+			log.Warn("Agent not found, sftp runs without agent: " + agentPath)
+			agentPath = ""
+		}
+	}
+
 	sshHandler := &client.DockerClient{}
 
 	ssh2docksal.SSHHandler(sshHandler, ssh2docksal.Config{
-		WelcomeMessage: c.String("welcome-message"),
+		WelcomeMessage:       c.String("welcome-message"),
+		SftpMode:             sftpMode,
+		SftpServiceModes:     sftpServiceModes,
+		AgentPath:            agentPath,
+		HostMounts:           c.Bool("host-mounts"),
+		HostRoot:             c.String("host-root"),
+		AtomicUploadServices: c.StringSlice("atomic-uploads"),
+		Umask:                umask,
+		SftpCacheTTL:         c.Duration("sftp-cache-ttl"),
+		SftpCacheSize:        c.Int("sftp-cache-size"),
+		SftpMaxExecs:         c.Int("sftp-max-execs"),
+		SftpPrefetch:         c.StringSlice("sftp-prefetch"),
+		SftpUploadBatch:      c.Duration("sftp-upload-batch"),
+		SftpPolicies:         sftpPolicies,
+		SftpMaxFileSize:      sftpLimits["sftp-max-file-size"],
+		SftpSessionQuota:     sftpLimits["sftp-session-quota"],
+		SftpDailyQuota:       sftpLimits["sftp-daily-quota"],
+		SftpMinFreeSpace:     sftpLimits["sftp-min-free-space"],
+		SftpTrash:            sftpTrash,
+		SftpTrashRetention:   c.Duration("sftp-trash-retention"),
+		UploadHooks:          uploadHooks,
+		TransferRates:        transferRates,
+		ChannelRate:          channelRate,
+		AuditLog:             auditLog,
 	})
 
+	hostKeys, err := ssh2docksal.LoadHostKeys(hostKeyPaths(c))
+	if err != nil {
+		log.Warn(err.Error())
+		return
+	}
+
 	bindPort := c.String("bind")
 	log.Info("Starting ssh server on port " + bindPort)
-	log.WithError(ssh.ListenAndServe(bindPort, nil, authorization))
+	log.WithError(ssh.ListenAndServe(bindPort, nil, authorization, ssh2docksal.HostKeys(hostKeys)))
 	log.Info("Server started")
 }
 
+// hostKeyPaths returns the paths of the host keys, the default keys in host-key-dir if none are set.
+func hostKeyPaths(c *cli.Context) []string {
+	if paths := c.GlobalStringSlice("host-key"); len(paths) > 0 {
+		return paths
+	}
+	return ssh2docksal.DefaultHostKeys(c.GlobalString("host-key-dir"))
+}
+
+// PrintHostKeys prints the fingerprints of the host keys, generating missing keys.
+func PrintHostKeys(c *cli.Context) {
+	lines, err := ssh2docksal.HostKeyFingerprints(hostKeyPaths(c))
+	if err != nil {
+		log.Warn(err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// defaultAgentPath returns the path of ssh2docksal-agent next to the executable.
+func defaultAgentPath() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(executable), "ssh2docksal-agent")
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Author = "Christian Wiedemann"
@@ -74,13 +232,144 @@ func main() {
 			Value: os.Getenv("HOME") + "/.ssh/authorized_keys",
 			Usage: "Path to your authorized key file.",
 		},
+		cli.StringSliceFlag{
+			Name:  "host-key",
+			Usage: "Path to a host key, generated if missing with the type in its name: ed25519, ecdsa or rsa. Can be repeated. Default are the keys in host-key-dir.",
+		},
+		cli.StringFlag{
+			Name:  "host-key-dir",
+			Value: os.Getenv("HOME") + "/.ssh2docksal",
+			Usage: "Folder of the default ed25519, ecdsa and rsa host keys.",
+		},
 		cli.StringFlag{
 			Name:  "welcome-message",
 			Value: "docksal",
 			Usage: "Welcome message",
 		},
+		cli.StringFlag{
+			Name:  "sftp-mode",
+			Value: "emulated",
+			Usage: "Sftp mode: [emulated|passthrough|auto]. passthrough uses the sftp-server of the container, auto falls back to emulated if there is none.",
+		},
+		cli.StringSliceFlag{
+			Name:  "sftp-service-mode",
+			Usage: "Sftp mode per service, e.g. cli=passthrough. Can be repeated.",
+		},
+		cli.BoolFlag{
+			Name:  "host-mounts",
+			Usage: "Serve sftp paths below bind mounts directly from the host file system. The host folders have to be mounted into ssh2docksal.",
+		},
+		cli.StringFlag{
+			Name:  "host-root",
+			Value: "",
+			Usage: "Folder the host file system is mounted to in ssh2docksal, e.g. /host. Default is the same path as on the host.",
+		},
+		cli.StringFlag{
+			Name:  "umask",
+			Value: "0022",
+			Usage: "Umask for files and folders created via sftp and scp.",
+		},
+		cli.DurationFlag{
+			Name:  "sftp-cache-ttl",
+			Value: 10 * time.Second,
+			Usage: "How long sftp sessions cache file metadata. 0 disables the cache.",
+		},
+		cli.IntFlag{
+			Name:  "sftp-cache-size",
+			Value: 10000,
+			Usage: "Maximum number of files cached per sftp session.",
+		},
+		cli.StringSliceFlag{
+			Name:  "sftp-prefetch",
+			Usage: "Folder whose whole tree is fetched at once when a folder in it is listed, e.g. /var/www. Can be repeated.",
+		},
+		cli.DurationFlag{
+			Name:  "sftp-upload-batch",
+			Usage: "How long closed sftp uploads are collected to be committed together, e.g. 50ms. Disabled by default.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-policy-file",
+			Usage: "JSON file with sftp policies (root, read_only, deny) per project, service and key.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-max-file-size",
+			Value: "0",
+			Usage: "Maximum size of files uploaded via sftp, e.g. 500M. 0 is unlimited.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-session-quota",
+			Value: "0",
+			Usage: "Maximum number of bytes written per sftp session, e.g. 2G. 0 is unlimited.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-daily-quota",
+			Value: "0",
+			Usage: "Maximum number of bytes written via sftp per key and day, e.g. 10G. 0 is unlimited.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-min-free-space",
+			Value: "0",
+			Usage: "Space sftp uploads leave free on the file system of the container, e.g. 1G. 0 disables the check.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-trash",
+			Usage: "Folder in the container sftp removals are moved to instead of deleting them, e.g. /var/www/.trash.",
+		},
+		cli.DurationFlag{
+			Name:  "sftp-trash-retention",
+			Value: 7 * 24 * time.Hour,
+			Usage: "How long files are kept in the sftp trash.",
+		},
+		cli.StringFlag{
+			Name:  "sftp-hooks-file",
+			Usage: "JSON file with commands run in the container after sftp uploads of matching files.",
+		},
+		cli.StringSliceFlag{
+			Name:  "transfer-rate",
+			Usage: "Rate limit of sftp and scp transfers, e.g. upload=10M,download=50M for all sessions or project=shop,download=5M and key=SHA256:...,upload=1M. Can be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "channel-rate",
+			Value: "0",
+			Usage: "Rate limit per ssh session and direction in bytes per second, including shells and commands like rsync, e.g. 10M. 0 is unlimited.",
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "File the sftp file operations are logged to in JSON Lines format, syslog or syslog://host:port for a remote syslog.",
+		},
+		cli.StringFlag{
+			Name:  "audit-log-max-size",
+			Value: "100M",
+			Usage: "Size at which the audit log file is rotated. 0 never rotates it.",
+		},
+		cli.IntFlag{
+			Name:  "audit-log-keep",
+			Value: 5,
+			Usage: "Number of rotated audit log files kept.",
+		},
+		cli.IntFlag{
+			Name:  "sftp-max-execs",
+			Value: 8,
+			Usage: "Maximum number of docker execs per sftp session in flight at the same time.",
+		},
+		cli.StringSliceFlag{
+			Name:  "atomic-uploads",
+			Usage: "Service which uploads sftp files to a temporary name and renames them once complete, e.g. cli or * for all. Can be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "agent",
+			Value: defaultAgentPath(),
+			Usage: "Path to the ssh2docksal-agent binary which is copied into the containers for fast sftp. Empty to disable.",
+		},
 	}
 	log.Infof("Welcome to ssh2docksal %s", app.Version)
 	app.Action = StartServer
+	app.Commands = []cli.Command{
+		{
+			Name:   "hostkeys",
+			Usage:  "Print the fingerprints of the host keys",
+			Action: PrintHostKeys,
+		},
+	}
 	app.Run(os.Args)
 }
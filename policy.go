@@ -0,0 +1,87 @@
+package ssh2docksal
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// SftpPolicy restricts the emulated sftp sessions it applies to.
+type SftpPolicy struct {
+	// Project, Service and Key select the sessions, empty values match all sessions.
+	// Key is the SHA256 fingerprint of the public key, e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+	Project string `json:"project"`
+	Service string `json:"service"`
+	Key     string `json:"key"`
+	// Root jails the session to a folder of the container.
+	Root string `json:"root"`
+	// ReadOnly denies all changes.
+	ReadOnly bool `json:"read_only"`
+	// Deny lists glob patterns of paths which can't be accessed. Patterns without
+	// a slash match file names, others match container paths.
+	Deny []string `json:"deny"`
+}
+
+// Restricted checks if the policy restricts the session.
+func (policy *SftpPolicy) Restricted() bool {
+	return policy.Root != "" && policy.Root != "/" || policy.ReadOnly || len(policy.Deny) > 0
+}
+
+// matches checks if the policy applies to the session of config.
+func (policy *SftpPolicy) matches(config *Config) bool {
+	return (policy.Project == "" || policy.Project == config.Project) &&
+		(policy.Service == "" || policy.Service == config.Service) &&
+		(policy.Key == "" || policy.Key == config.SessionKey)
+}
+
+// GetSftpPolicy returns the policy of the current session. All matching policies
+// apply: read-only and deny patterns add up, the root of the last policy with a root wins.
+func (config *Config) GetSftpPolicy() SftpPolicy {
+	var result SftpPolicy
+	for i := range config.SftpPolicies {
+		policy := &config.SftpPolicies[i]
+		if !policy.matches(config) {
+			continue
+		}
+		if policy.Root != "" {
+			result.Root = path.Clean(policy.Root)
+		}
+		result.ReadOnly = result.ReadOnly || policy.ReadOnly
+		result.Deny = append(result.Deny, policy.Deny...)
+	}
+	return result
+}
+
+// LoadSftpPolicies reads a JSON list of sftp policies.
+func LoadSftpPolicies(file string) ([]SftpPolicy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var policies []SftpPolicy
+	if err := json.Unmarshal(content, &policies); err != nil {
+		return nil, fmt.Errorf("Invalid sftp policy file %s: %s", file, err.Error())
+	}
+	for _, policy := range policies {
+		if policy.Root != "" && !strings.HasPrefix(policy.Root, "/") {
+			return nil, fmt.Errorf("Sftp policy root %s is not absolute", policy.Root)
+		}
+		for _, pattern := range policy.Deny {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid sftp policy pattern %s", pattern)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// KeyFingerprint returns the SHA256 fingerprint of a public key as printed by ssh-keygen -l.
+func KeyFingerprint(key ssh.PublicKey) string {
+	hash := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
@@ -1,12 +1,18 @@
 package ssh2docksal
 
 import (
+	"errors"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/common-nighthawk/go-figure"
 	"github.com/gliderlabs/ssh"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/sftp"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,13 +22,207 @@ type dockerClientInterface interface {
 	Execute(containerID string, s ssh.Session, c Config)
 	Find(containerName string) (string, error)
 	SftpHandler(containerID string, config Config) sftp.Handlers
+	SftpPassthrough(containerID string, s ssh.Session, c Config) error
+	Scp(containerID string, s ssh.Session, c Config)
+	Trash(containerID string, s ssh.Session, c Config)
 }
 
+// SftpExtensionHandler is implemented by sftp handlers which answer protocol
+// extensions the sftp request server doesn't support.
+type SftpExtensionHandler interface {
+	// SftpChannel wraps the channel of the sftp subsystem.
+	SftpChannel(channel io.ReadWriteCloser) io.ReadWriteCloser
+}
+
+// Sftp modes
+const (
+	// SftpModeEmulated serves sftp with the emulated file system of the client package.
+	SftpModeEmulated = "emulated"
+	// SftpModePassthrough pipes sftp into the sftp-server binary of the container.
+	SftpModePassthrough = "passthrough"
+	// SftpModeAuto uses passthrough if the container has a sftp-server binary and falls back to emulated.
+	SftpModeAuto = "auto"
+)
+
+// ErrSftpServerNotFound is returned if the container has no sftp-server binary.
+var ErrSftpServerNotFound = errors.New("sftp-server not found")
+
 // Config for ssh options
 type Config struct {
 	WelcomeMessage string
 	DockerUser     string
 	Cache          *cache.Cache
+	// SftpMode is the default sftp mode.
+	SftpMode string
+	// SftpServiceModes overrides the sftp mode per service, e.g. "cli" => "passthrough".
+	SftpServiceModes map[string]string
+	// AgentPath is the path to the ssh2docksal-agent binary. Empty disables the agent.
+	AgentPath string
+	// HostMounts serves sftp paths below bind mounts directly from the host file system.
+	HostMounts bool
+	// HostRoot is the folder the host file system is visible at, e.g. "/host". Empty for "/".
+	HostRoot string
+	// AtomicUploadServices lists the services which upload sftp files to a temporary
+	// name and rename them over the target once complete. "*" enables all services.
+	AtomicUploadServices []string
+	// Umask applied to files and folders created via sftp and scp, octal. Default is 0022.
+	Umask string
+	// SftpCacheTTL is how long sftp sessions cache file metadata. 0 disables the cache.
+	SftpCacheTTL time.Duration
+	// SftpCacheSize is the maximum number of files cached per sftp session. Default is 10000.
+	SftpCacheSize int
+	// SftpPrefetch are folders whose whole tree is fetched at once when a folder in it is listed.
+	SftpPrefetch []string
+	// SftpUploadBatch is how long closed sftp uploads are collected to be committed
+	// together. 0, the default, commits every upload on close.
+	SftpUploadBatch time.Duration
+	// SftpMaxExecs is the maximum number of docker round trips per sftp session
+	// in flight at the same time. Default is 8.
+	SftpMaxExecs int
+	// SftpPolicies restrict sftp sessions per project, service and key.
+	SftpPolicies []SftpPolicy
+	// SftpMaxFileSize is the maximum size of files uploaded via sftp in bytes. 0 is unlimited.
+	SftpMaxFileSize int64
+	// SftpSessionQuota is the maximum number of bytes written per sftp session. 0 is unlimited.
+	SftpSessionQuota int64
+	// SftpDailyQuota is the maximum number of bytes written via sftp per key and day. 0 is unlimited.
+	SftpDailyQuota int64
+	// SftpMinFreeSpace is the space in bytes sftp uploads leave free on the file
+	// system of the container. 0 disables the check.
+	SftpMinFreeSpace int64
+	// SftpTrash is the folder in the container sftp removals are moved to. Empty deletes the files.
+	SftpTrash string
+	// SftpTrashRetention is how long trashed files are kept. Default is 7 days.
+	SftpTrashRetention time.Duration
+	// UploadHooks run commands in the container after sftp uploads.
+	UploadHooks []UploadHook
+	// TransferRates limit the sftp and scp transfers globally or per project and key.
+	TransferRates []*TransferRate
+	// ChannelRate limits each session channel, including shells and commands
+	// like rsync, in bytes per second and direction. 0 is unlimited.
+	ChannelRate int64
+	// Project and Service of the current session.
+	Project string
+	Service string
+	// SessionKey is the fingerprint of the public key of the current session.
+	SessionKey string
+	// RemoteAddr is the address of the client of the current session.
+	RemoteAddr string
+	// AuditLog records the file operations of sftp sessions, nil disables it.
+	AuditLog *AuditLog
+}
+
+// GetSftpCacheSize returns the maximum number of files cached per sftp session.
+func (config *Config) GetSftpCacheSize() int {
+	if config.SftpCacheSize <= 0 {
+		return 10000
+	}
+	return config.SftpCacheSize
+}
+
+// GetSftpMaxExecs returns the maximum number of docker round trips per sftp session in flight.
+func (config *Config) GetSftpMaxExecs() int {
+	if config.SftpMaxExecs <= 0 {
+		return 8
+	}
+	return config.SftpMaxExecs
+}
+
+// GetSftpTrash returns the cleaned trash folder, "" if removals delete the files.
+func (config *Config) GetSftpTrash() string {
+	if config.SftpTrash == "" {
+		return ""
+	}
+	return path.Clean(config.SftpTrash)
+}
+
+// GetSftpTrashRetention returns how long trashed files are kept.
+func (config *Config) GetSftpTrashRetention() time.Duration {
+	if config.SftpTrashRetention <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return config.SftpTrashRetention
+}
+
+// SftpLimited checks if sftp uploads are limited.
+func (config *Config) SftpLimited() bool {
+	return config.SftpMaxFileSize > 0 || config.SftpSessionQuota > 0 || config.SftpDailyQuota > 0 || config.SftpMinFreeSpace > 0
+}
+
+// DailyQuotaKey returns the key the daily sftp quota is counted for: the key
+// fingerprint of the session or the project for sessions without key.
+func (config *Config) DailyQuotaKey() string {
+	if config.SessionKey != "" {
+		return config.SessionKey
+	}
+	return "project:" + config.Project
+}
+
+// AtomicUploads checks if uploads of the current service are atomic.
+func (config *Config) AtomicUploads() bool {
+	for _, service := range config.AtomicUploadServices {
+		if service == "*" || service == config.Service {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSftpMode returns the sftp mode of the given service.
+func (config *Config) GetSftpMode(service string) string {
+	if mode, ok := config.SftpServiceModes[service]; ok {
+		return mode
+	}
+	if config.SftpMode == "" {
+		return SftpModeEmulated
+	}
+	return config.SftpMode
+}
+
+// sessionSftpMode returns the sftp mode of a session with policy. Policies,
+// upload limits, hooks, the audit log and the trash are implemented by the
+// emulated sftp server only.
+func (config *Config) sessionSftpMode(service string, policy SftpPolicy) string {
+	if policy.Restricted() || config.SftpLimited() || len(config.GetUploadHooks()) > 0 || config.AuditLog != nil || config.GetSftpTrash() != "" {
+		return SftpModeEmulated
+	}
+	return config.GetSftpMode(service)
+}
+
+// GetUmask returns the umask for new files and folders.
+func (config *Config) GetUmask() os.FileMode {
+	umask, err := strconv.ParseUint(config.Umask, 8, 32)
+	if config.Umask == "" || err != nil {
+		return 0022
+	}
+	return os.FileMode(umask) & os.ModePerm
+}
+
+// IsValidUmask checks if umask is an octal umask like 0022.
+func IsValidUmask(umask string) bool {
+	value, err := strconv.ParseUint(umask, 8, 32)
+	return err == nil && value <= 0777
+}
+
+// ParseSize parses a size in bytes with an optional K, M, G or T suffix, e.g. 100M.
+func ParseSize(size string) (int64, error) {
+	units := map[byte]uint{'K': 10, 'M': 20, 'G': 30, 'T': 40}
+	number, shift := strings.ToUpper(size), uint(0)
+	if number != "" {
+		if unit, ok := units[number[len(number)-1]]; ok {
+			number, shift = number[:len(number)-1], unit
+		}
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("Invalid size %s", size)
+	}
+	return value << shift, nil
+}
+
+// IsValidSftpMode checks if mode is a known sftp mode.
+func IsValidSftpMode(mode string) bool {
+	return mode == SftpModeEmulated || mode == SftpModePassthrough || mode == SftpModeAuto
 }
 
 func (config *Config) getCache() *cache.Cache {
@@ -46,6 +246,28 @@ func getContainerNames(username string) (string, string) {
 	}
 	return projectName, container
 }
+
+// isTrashCommand checks if the command lists or restores the trash of sftp removals.
+func isTrashCommand(command []string) bool {
+	return len(command) > 0 && command[0] == "ssh2docksal-trash"
+}
+
+// isScpCommand checks if the command is a remote scp upload (-t) or download (-f).
+func isScpCommand(command []string) bool {
+	if len(command) == 0 || path.Base(command[0]) != "scp" {
+		return false
+	}
+	for _, arg := range command[1:] {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		if strings.ContainsAny(arg, "tf") {
+			return true
+		}
+	}
+	return false
+}
+
 func getContainerID(client dockerClientInterface, username string) (string, error) {
 	projectName, container := getContainerNames(username)
 	containerName := projectName + "_" + container + "_1"
@@ -54,9 +276,12 @@ func getContainerID(client dockerClientInterface, username string) (string, erro
 
 // SSHHandler handles the ssh connection
 func SSHHandler(sshHandler dockerClientInterface, config Config) {
+	// The container cache is shared by all sessions.
+	c := config.getCache()
 	ssh.Handle(func(s ssh.Session) {
+		// Each session gets its own copy for its project, service and key.
+		config := config
 		log.Debugf("Looking for  container %s", s.User())
-		c := config.getCache()
 		var err error
 		var existingContainer string
 
@@ -90,15 +315,56 @@ func SSHHandler(sshHandler dockerClientInterface, config Config) {
 			return
 		}
 		projectName, container := getContainerNames(s.User())
+		config.Project = projectName
+		config.Service = container
 		config.DockerUser = "root"
 		if container == "cli" {
 			config.DockerUser = "docker"
 		}
+		config.SessionKey = ""
+		config.RemoteAddr = s.RemoteAddr().String()
+		if key := s.PublicKey(); key != nil {
+			config.SessionKey = KeyFingerprint(key)
+		}
+		policy := config.GetSftpPolicy()
+		if policy.Restricted() && s.Subsystem() != "sftp" {
+			// Shells and scp would bypass the policy.
+			log.Warnf("Session of %s is restricted to sftp by a policy", s.User())
+			fmt.Fprintf(s.Stderr(), "This key is restricted to sftp.\n")
+			s.Exit(1)
+			return
+		}
+		s = throttleSession(s, &config, s.Subsystem() == "sftp" || isScpCommand(s.Command()))
 		if s.Subsystem() == "sftp" {
+			mode := config.sessionSftpMode(container, policy)
+			if mode != SftpModeEmulated {
+				log.Debugf("Start sftp passthrough")
+				err = sshHandler.SftpPassthrough(existingContainer, s, config)
+				if err == nil {
+					return
+				}
+				if err != ErrSftpServerNotFound || mode == SftpModePassthrough {
+					log.Errorf("Sftp passthrough for %s failed: %s", s.User(), err.Error())
+					s.Exit(1)
+					return
+				}
+				log.Debugf("No sftp-server in %s. Fall back to emulated sftp", s.User())
+			}
 			log.Debugf("Start sftp")
-			sftpServer := sftp.NewRequestServer(s, sshHandler.SftpHandler(existingContainer, config))
+			handlers := sshHandler.SftpHandler(existingContainer, config)
+			var channel io.ReadWriteCloser = s
+			if extensions, ok := handlers.FileCmd.(SftpExtensionHandler); ok {
+				channel = extensions.SftpChannel(s)
+			}
+			sftpServer := sftp.NewRequestServer(channel, handlers)
 			_ = sftpServer.Serve()
 
+		} else if isTrashCommand(s.Command()) {
+			log.Debugf("Start trash command")
+			sshHandler.Trash(existingContainer, s, config)
+		} else if isScpCommand(s.Command()) {
+			log.Debugf("Start scp")
+			sshHandler.Scp(existingContainer, s, config)
 		} else {
 			_, _, isPty := s.Pty()
 			if config.WelcomeMessage != "" && isPty == true && len(s.Command()) == 0 {
@@ -1,11 +1,21 @@
 package ssh2docksal
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"github.com/apex/log"
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/sftp"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testIntegration = flag.Bool("integration", false, "perform integration tests against sftp server process")
@@ -19,6 +29,18 @@ func (a *testClient) Execute(containerID string, s ssh.Session, c Config) {
 
 }
 
+func (a *testClient) SftpPassthrough(containerID string, s ssh.Session, c Config) error {
+	return ErrSftpServerNotFound
+}
+
+func (a *testClient) Scp(containerID string, s ssh.Session, c Config) {
+
+}
+
+func (a *testClient) Trash(containerID string, s ssh.Session, c Config) {
+
+}
+
 type testClient struct {
 }
 
@@ -53,3 +75,438 @@ func TestGetContainerID(t *testing.T) {
 		}
 	}
 }
+
+func TestIsScpCommand(t *testing.T) {
+
+	tests := []struct {
+		command []string
+		isScp   bool
+	}{
+		{command: []string{"scp", "-t", "--", "/var/www"}, isScp: true},
+		{command: []string{"scp", "-r", "-d", "-t", "--", "/var/www"}, isScp: true},
+		{command: []string{"scp", "-pf", "README.md"}, isScp: true},
+		{command: []string{"/usr/bin/scp", "-f", "README.md"}, isScp: true},
+		{command: []string{"scp", "--", "-t"}, isScp: false},
+		{command: []string{"scp", "README.md", "host:README.md"}, isScp: false},
+		{command: []string{"ls", "-t"}, isScp: false},
+		{command: []string{}, isScp: false},
+	}
+
+	for _, test := range tests {
+		if isScpCommand(test.command) != test.isScp {
+			t.Errorf("isScpCommand(%v) should be %t", test.command, test.isScp)
+		}
+	}
+}
+
+func TestGetSftpMode(t *testing.T) {
+
+	config := Config{
+		SftpMode:         SftpModeAuto,
+		SftpServiceModes: map[string]string{"db": SftpModeEmulated, "cli": SftpModePassthrough},
+	}
+	tests := []struct {
+		service string
+		mode    string
+	}{
+		{service: "cli", mode: SftpModePassthrough},
+		{service: "db", mode: SftpModeEmulated},
+		{service: "web", mode: SftpModeAuto},
+	}
+
+	for _, test := range tests {
+		if mode := config.GetSftpMode(test.service); mode != test.mode {
+			t.Errorf("Sftp mode of %s should be %s, got %s", test.service, test.mode, mode)
+		}
+	}
+
+	emptyConfig := Config{}
+	if mode := emptyConfig.GetSftpMode("cli"); mode != SftpModeEmulated {
+		t.Errorf("Default sftp mode should be %s, got %s", SftpModeEmulated, mode)
+	}
+
+	if mode := config.sessionSftpMode("cli", SftpPolicy{}); mode != SftpModePassthrough {
+		t.Errorf("Sessions of cli should use %s, got %s", SftpModePassthrough, mode)
+	}
+	config.SftpTrash = "/var/www/.trash"
+	if mode := config.sessionSftpMode("cli", SftpPolicy{}); mode != SftpModeEmulated {
+		t.Errorf("Sessions with a trash should use %s, got %s", SftpModeEmulated, mode)
+	}
+	config.SftpTrash = ""
+	if mode := config.sessionSftpMode("cli", SftpPolicy{ReadOnly: true}); mode != SftpModeEmulated {
+		t.Errorf("Restricted sessions should use %s, got %s", SftpModeEmulated, mode)
+	}
+}
+
+func TestAtomicUploads(t *testing.T) {
+	config := Config{AtomicUploadServices: []string{"cli"}, Service: "cli"}
+	if !config.AtomicUploads() {
+		t.Errorf("Uploads of cli should be atomic")
+	}
+	config.Service = "web"
+	if config.AtomicUploads() {
+		t.Errorf("Uploads of web should not be atomic")
+	}
+	config.AtomicUploadServices = []string{"*"}
+	if !config.AtomicUploads() {
+		t.Errorf("* should enable atomic uploads for all services")
+	}
+}
+
+func TestGetUmask(t *testing.T) {
+	tests := []struct {
+		umask string
+		mode  os.FileMode
+	}{
+		{umask: "", mode: 0022},
+		{umask: "0002", mode: 0002},
+		{umask: "077", mode: 0077},
+		{umask: "invalid", mode: 0022},
+	}
+	for _, test := range tests {
+		config := Config{Umask: test.umask}
+		if mode := config.GetUmask(); mode != test.mode {
+			t.Errorf("Umask of %q should be %o, got %o", test.umask, test.mode, mode)
+		}
+	}
+	if IsValidUmask("0999") || IsValidUmask("01000") || !IsValidUmask("0027") {
+		t.Errorf("IsValidUmask accepts invalid or rejects valid umasks")
+	}
+}
+
+func TestGetSftpCacheSize(t *testing.T) {
+	if size := (&Config{}).GetSftpCacheSize(); size != 10000 {
+		t.Errorf("Default sftp cache size should be 10000, got %d", size)
+	}
+	if size := (&Config{SftpCacheSize: 50}).GetSftpCacheSize(); size != 50 {
+		t.Errorf("Sftp cache size should be 50, got %d", size)
+	}
+}
+
+func TestGetSftpMaxExecs(t *testing.T) {
+	if execs := (&Config{}).GetSftpMaxExecs(); execs != 8 {
+		t.Errorf("Default sftp max execs should be 8, got %d", execs)
+	}
+	if execs := (&Config{SftpMaxExecs: 2}).GetSftpMaxExecs(); execs != 2 {
+		t.Errorf("Sftp max execs should be 2, got %d", execs)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for size, expected := range map[string]int64{"0": 0, "512": 512, "10k": 10 << 10, "100M": 100 << 20, "2G": 2 << 30, "1T": 1 << 40} {
+		if value, err := ParseSize(size); err != nil || value != expected {
+			t.Errorf("ParseSize(%q) = %d, %v want %d", size, value, err, expected)
+		}
+	}
+	for _, size := range []string{"", "M", "-1", "1.5G", "10MB", "9999999999T"} {
+		if _, err := ParseSize(size); err == nil {
+			t.Errorf("ParseSize(%q) should fail", size)
+		}
+	}
+}
+
+func TestDailyQuotaKey(t *testing.T) {
+	if key := (&Config{Project: "shop", SessionKey: "SHA256:abc"}).DailyQuotaKey(); key != "SHA256:abc" {
+		t.Errorf("Daily quota should be counted per key, got %s", key)
+	}
+	if key := (&Config{Project: "shop"}).DailyQuotaKey(); key != "project:shop" {
+		t.Errorf("Daily quota of sessions without key should be counted per project, got %s", key)
+	}
+}
+
+func TestGetSftpPolicy(t *testing.T) {
+	config := Config{
+		Project: "drupal",
+		Service: "web",
+		SftpPolicies: []SftpPolicy{
+			{Deny: []string{".env"}},
+			{Project: "drupal", Root: "/var/www/docroot/"},
+			{Project: "drupal", Service: "web", Deny: []string{"settings.php"}},
+			{Project: "other", ReadOnly: true},
+			{Key: "SHA256:editor", Root: "/var/www/docroot/sites/default/files", ReadOnly: true},
+		},
+	}
+	policy := config.GetSftpPolicy()
+	if policy.Root != "/var/www/docroot" || policy.ReadOnly || len(policy.Deny) != 2 {
+		t.Errorf("Unexpected policy %+v", policy)
+	}
+	config.SessionKey = "SHA256:editor"
+	if policy := config.GetSftpPolicy(); policy.Root != "/var/www/docroot/sites/default/files" || !policy.ReadOnly {
+		t.Errorf("Expected the key policy, got %+v", policy)
+	}
+	if policy := (&Config{}).GetSftpPolicy(); policy.Restricted() {
+		t.Errorf("Sessions without policies should not be restricted")
+	}
+	if policy := (SftpPolicy{Root: "/"}); policy.Restricted() {
+		t.Errorf("The root / should not restrict the session")
+	}
+}
+
+func TestLoadSftpPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policies.json")
+	ioutil.WriteFile(file, []byte(`[{"project": "drupal", "root": "/var/www", "read_only": true, "deny": ["*.php"]}]`), 0644)
+	policies, err := LoadSftpPolicies(file)
+	if err != nil || len(policies) != 1 || !policies[0].ReadOnly || policies[0].Deny[0] != "*.php" {
+		t.Errorf("Unexpected policies %+v %v", policies, err)
+	}
+	for _, content := range []string{`{}`, `[{"root": "var/www"}]`, `[{"deny": ["a["]}]`} {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		if _, err := LoadSftpPolicies(file); err == nil {
+			t.Errorf("Expected an error for %s", content)
+		}
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	content, err := ioutil.ReadFile("tests/id_rsa.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := KeyFingerprint(key); fingerprint != "SHA256:+D8zj/T2d2JHFJ5H6ZZ+dNkj0gVK6uxlnrFf+xOIO2k" {
+		t.Errorf("Unexpected fingerprint %s", fingerprint)
+	}
+}
+
+func TestParseTransferRate(t *testing.T) {
+	rate, err := ParseTransferRate("project=shop,key=SHA256:abc+/d,upload=1M,download=512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate.Project != "shop" || rate.Key != "SHA256:abc+/d" || rate.Upload != 1<<20 || rate.Download != 512<<10 {
+		t.Errorf("Unexpected transfer rate %+v", rate)
+	}
+	for _, value := range []string{"", "project=shop", "upload=fast", "upload=1M,speed=2M", "download"} {
+		if _, err := ParseTransferRate(value); err == nil {
+			t.Errorf("ParseTransferRate(%q) should fail", value)
+		}
+	}
+}
+
+// bufferSession is a session which writes to a buffer.
+type bufferSession struct {
+	ssh.Session
+	buffer bytes.Buffer
+}
+
+func (s *bufferSession) Read(p []byte) (int, error) {
+	return s.buffer.Read(p)
+}
+
+func (s *bufferSession) Write(p []byte) (int, error) {
+	return s.buffer.Write(p)
+}
+
+func TestThrottleSession(t *testing.T) {
+	global, _ := ParseTransferRate("download=64K")
+	other, _ := ParseTransferRate("project=other,upload=1K")
+	config := &Config{Project: "shop", TransferRates: []*TransferRate{global, other}}
+	s := &bufferSession{}
+	if throttleSession(s, config, false) != s {
+		t.Errorf("Transfer rates should not limit other sessions")
+	}
+	throttled, ok := throttleSession(s, config, true).(*throttledSession)
+	if !ok || len(throttled.downloads) != 1 || len(throttled.uploads) != 0 {
+		t.Fatalf("Expected the global download rate only")
+	}
+
+	// The bucket holds one second, the rest takes half a second.
+	start := time.Now()
+	if n, err := throttled.Write(make([]byte, 96<<10)); n != 96<<10 || err != nil {
+		t.Fatalf("Unexpected write %d %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the write to take about half a second, took %s", elapsed)
+	}
+	if s.buffer.Len() != 96<<10 {
+		t.Errorf("Expected all data to be written, got %d bytes", s.buffer.Len())
+	}
+
+	config.ChannelRate = 1 << 20
+	if throttled, ok := throttleSession(s, config, false).(*throttledSession); !ok || len(throttled.uploads) != 1 || len(throttled.downloads) != 1 {
+		t.Errorf("Expected the channel rate to limit all sessions")
+	}
+}
+
+// userSession is a shell session of user with key.
+type userSession struct {
+	bufferSession
+	user string
+	key  ssh.PublicKey
+}
+
+func (s *userSession) User() string                            { return s.user }
+func (s *userSession) RemoteAddr() net.Addr                    { return &net.TCPAddr{IP: net.IPv4(192, 168, 64, 1)} }
+func (s *userSession) PublicKey() ssh.PublicKey                { return s.key }
+func (s *userSession) Subsystem() string                       { return "" }
+func (s *userSession) Command() []string                       { return nil }
+func (s *userSession) Pty() (ssh.Pty, <-chan ssh.Window, bool) { return ssh.Pty{}, nil, false }
+
+// recordClient records the config of executed sessions per container.
+type recordClient struct {
+	testClient
+	lock    sync.Mutex
+	configs map[string][]Config
+}
+
+func (a *recordClient) Execute(containerID string, s ssh.Session, c Config) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.configs[containerID] = append(a.configs[containerID], c)
+}
+
+func TestSSHHandlerSessions(t *testing.T) {
+	content, err := ioutil.ReadFile("tests/id_rsa.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &recordClient{configs: make(map[string][]Config)}
+	SSHHandler(client, Config{})
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			ssh.DefaultHandler(&userSession{user: "shop", key: key})
+		}()
+		go func() {
+			defer wait.Done()
+			ssh.DefaultHandler(&userSession{user: "blog---php"})
+		}()
+	}
+	wait.Wait()
+	for _, config := range client.configs["shop_cli_1"] {
+		if config.Project != "shop" || config.DockerUser != "docker" || config.SessionKey != KeyFingerprint(key) {
+			t.Fatalf("Expected the config of the shop session, got %+v", config)
+		}
+	}
+	for _, config := range client.configs["blog_php_1"] {
+		if config.Project != "blog" || config.DockerUser != "root" || config.SessionKey != "" {
+			t.Fatalf("Expected the config of the blog session, got %+v", config)
+		}
+	}
+	if len(client.configs["shop_cli_1"]) != 20 || len(client.configs["blog_php_1"]) != 20 {
+		t.Errorf("Expected all sessions to execute")
+	}
+}
+
+func TestUploadHookMatches(t *testing.T) {
+	hook := UploadHook{Paths: []string{"*.php", "/var/www/docroot/themes/*/templates/*"}}
+	for name, expected := range map[string]bool{
+		"/var/www/docroot/index.php":                       true,
+		"/var/www/docroot/themes/shop/templates/page.twig": true,
+		"/var/www/docroot/themes/shop/css/style.css":       false,
+	} {
+		if hook.Matches(name) != expected {
+			t.Errorf("Matches(%s) should be %v", name, expected)
+		}
+	}
+	if debounce := (&UploadHook{}).GetDebounce(); debounce != 500*time.Millisecond {
+		t.Errorf("Default debounce should be 500ms, got %s", debounce)
+	}
+	config := &Config{Project: "shop", Service: "cli", UploadHooks: []UploadHook{{Service: "cli"}, {Project: "blog"}}}
+	if hooks := config.GetUploadHooks(); len(hooks) != 1 {
+		t.Errorf("Expected the hooks of the session, got %d", len(hooks))
+	}
+}
+
+func TestLoadUploadHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hooks.json")
+	ioutil.WriteFile(file, []byte(`[{"service": "cli", "paths": ["*.twig"], "command": "drush cr", "debounce": "2s"}]`), 0644)
+	hooks, err := LoadUploadHooks(file)
+	if err != nil || len(hooks) != 1 || hooks[0].Command != "drush cr" || hooks[0].GetDebounce() != 2*time.Second {
+		t.Errorf("Unexpected hooks %+v %v", hooks, err)
+	}
+	for _, content := range []string{`{}`, `[{"paths": ["*.php"]}]`, `[{"paths": ["[a"], "command": "true"}]`, `[{"paths": ["*"], "command": "true", "debounce": "soon"}]`} {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		if _, err := LoadUploadHooks(file); err == nil {
+			t.Errorf("Expected %s to be invalid", content)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	auditLog, err := OpenAuditLog(file, 500, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{SessionKey: "SHA256:abc", RemoteAddr: "192.168.64.1:50000", Project: "shop", Service: "cli", AuditLog: auditLog}
+	config.Audit("write", "/var/www/index.php", "", 42, nil)
+	content, _ := ioutil.ReadFile(file)
+	var entry AuditEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Key != "SHA256:abc" || entry.RemoteAddr != "192.168.64.1:50000" || entry.Project != "shop" || entry.Op != "write" || entry.Bytes != 42 || entry.Result != "ok" {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	config.Audit("rename", "/var/www/a.php", "/var/www/b.php", 0, errors.New("file does not exist"))
+	config.Audit("remove", "/var/www/b.php", "", 0, nil)
+	content, _ = ioutil.ReadFile(file)
+	if err := json.Unmarshal(content, &entry); err != nil || entry.Op != "remove" {
+		t.Errorf("Expected the log to be rotated before the last entry, got %s", content)
+	}
+	content, _ = ioutil.ReadFile(file + ".1")
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"result":"failed","error":"file does not exist"`) {
+		t.Errorf("Expected the rotated entries in %s.1, got %s", file, content)
+	}
+	(&Config{}).Audit("write", "/var/www/index.php", "", 0, nil)
+}
+
+func TestLoadHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh2docksal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := DefaultHostKeys(filepath.Join(dir, "keys"))
+	fingerprints, err := HostKeyFingerprints(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, keyType := range []string{"ssh-ed25519", "ecdsa-sha2-nistp256", "ssh-rsa"} {
+		if !strings.HasPrefix(fingerprints[i], keyType+" SHA256:") {
+			t.Errorf("Expected a %s key, got %s", keyType, fingerprints[i])
+		}
+		if stat, err := os.Stat(paths[i]); err != nil || stat.Mode().Perm() != 0600 {
+			t.Errorf("Expected %s to be private, got %v", paths[i], err)
+		}
+		if _, err := os.Stat(paths[i] + ".pub"); err != nil {
+			t.Errorf("Expected the public key of %s", paths[i])
+		}
+	}
+	if again, _ := HostKeyFingerprints(paths); strings.Join(again, "\n") != strings.Join(fingerprints, "\n") {
+		t.Errorf("Expected the keys to be kept, got %q instead of %q", again, fingerprints)
+	}
+
+	if _, err := LoadHostKeys([]string{filepath.Join(dir, "host_key")}); err == nil {
+		t.Errorf("Expected keys without type in their name to fail")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "invalid_rsa_key"), []byte("invalid"), 0600)
+	if _, err := LoadHostKeys([]string{filepath.Join(dir, "invalid_rsa_key")}); err == nil {
+		t.Errorf("Expected invalid keys to fail")
+	}
+}
@@ -31,6 +31,22 @@
   [[ "$output" =~ "tty-upload.txt" ]]
 }
 
+@test "Test scp recursive upload and download" {
+  run scp -r -p -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no  -P 2222  sftp_test ssh2docksal_target@192.168.64.100:/tmp/scp_test
+  [ $status = 0 ]
+  run ssh -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no ssh2docksal_target@192.168.64.100 -p 2222 ls /tmp/scp_test
+  [[ "$output" =~ "sftp_test.txt" ]]
+  rm -rf download_scp_test
+  run scp -r -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no  -P 2222 ssh2docksal_target@192.168.64.100:/tmp/scp_test download_scp_test
+  [ $status = 0 ]
+  run ls download_scp_test
+  [[ "$output" =~ "sftp_test.txt" ]]
+}
+
+@test "Test scp to container without scp" {
+  run scp -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no  -P 2222  tty-upload.txt ssh2docksal_target---db@192.168.64.100:/tmp/tty-upload.txt
+  [ $status = 0 ]
+}
 
 teardown() {
     echo "Status: $status"
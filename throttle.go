@@ -0,0 +1,171 @@
+package ssh2docksal
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the largest write which waits for the limiters at once, so
+// throttled sessions sharing a limiter take turns.
+const throttleChunk = 32 << 10
+
+// RateLimiter is a token bucket of bytes per second. The bucket holds the
+// bytes of one second.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second.
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// WaitN takes n bytes from the bucket and waits until they are available.
+// Bytes taken beyond the bucket are paid back by the following calls.
+func (l *RateLimiter) WaitN(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// TransferRate limits the sftp and scp transfers of the sessions it applies
+// to. Rates without project and key apply to all sessions. All sessions of a
+// rate share its limit.
+type TransferRate struct {
+	// Project and Key select the sessions, Key is the SHA256 fingerprint of the public key.
+	Project string
+	Key     string
+	// Upload and Download are the rates in bytes per second, 0 is unlimited.
+	Upload   int64
+	Download int64
+	upload   *RateLimiter
+	download *RateLimiter
+}
+
+// ParseTransferRate parses a transfer rate like "project=shop,upload=1M,download=5M".
+func ParseTransferRate(value string) (*TransferRate, error) {
+	rate := &TransferRate{}
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid transfer rate %s", value)
+		}
+		var err error
+		switch parts[0] {
+		case "project":
+			rate.Project = parts[1]
+		case "key":
+			rate.Key = parts[1]
+		case "upload":
+			rate.Upload, err = ParseSize(parts[1])
+		case "download":
+			rate.Download, err = ParseSize(parts[1])
+		default:
+			err = fmt.Errorf("Unknown transfer rate field %s", parts[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rate.Upload == 0 && rate.Download == 0 {
+		return nil, fmt.Errorf("Transfer rate %s has neither upload nor download", value)
+	}
+	if rate.Upload > 0 {
+		rate.upload = NewRateLimiter(rate.Upload)
+	}
+	if rate.Download > 0 {
+		rate.download = NewRateLimiter(rate.Download)
+	}
+	return rate, nil
+}
+
+// matches checks if the rate applies to the session of config.
+func (rate *TransferRate) matches(config *Config) bool {
+	return (rate.Project == "" || rate.Project == config.Project) &&
+		(rate.Key == "" || rate.Key == config.SessionKey)
+}
+
+// throttleSession limits the session by the transfer rates of config if it
+// transfers files and by the channel rate. Returns s if nothing applies.
+func throttleSession(s ssh.Session, config *Config, transfer bool) ssh.Session {
+	var uploads, downloads []*RateLimiter
+	if transfer {
+		for _, rate := range config.TransferRates {
+			if !rate.matches(config) {
+				continue
+			}
+			if rate.upload != nil {
+				uploads = append(uploads, rate.upload)
+			}
+			if rate.download != nil {
+				downloads = append(downloads, rate.download)
+			}
+		}
+	}
+	if config.ChannelRate > 0 {
+		uploads = append(uploads, NewRateLimiter(config.ChannelRate))
+		downloads = append(downloads, NewRateLimiter(config.ChannelRate))
+	}
+	if len(uploads) == 0 && len(downloads) == 0 {
+		return s
+	}
+	return &throttledSession{Session: s, uploads: uploads, downloads: downloads}
+}
+
+// throttledSession limits the data the client sends (uploads) and receives
+// (downloads). Stderr is not limited.
+type throttledSession struct {
+	ssh.Session
+	uploads   []*RateLimiter
+	downloads []*RateLimiter
+}
+
+func (s *throttledSession) Read(p []byte) (int, error) {
+	if len(s.uploads) > 0 && len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := s.Session.Read(p)
+	for _, limiter := range s.uploads {
+		limiter.WaitN(n)
+	}
+	return n, err
+}
+
+func (s *throttledSession) Write(p []byte) (int, error) {
+	if len(s.downloads) == 0 {
+		return s.Session.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		for _, limiter := range s.downloads {
+			limiter.WaitN(len(chunk))
+		}
+		n, err := s.Session.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}